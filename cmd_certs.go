@@ -0,0 +1,292 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math/big"
+	peer "mutex/peer"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const certsUsage = `Usage:
+  mutex certs init [flags]              create the cluster CA in -dir
+  mutex certs issue [flags] NODE...     issue node certificates signed by that CA
+  mutex certs issue -client NAME...     issue LockService client certificates
+
+NODE is a node ID, or ID@HOST:PORT as in -peers, which also puts HOST in the
+certificate. Comma-separated lists are split, so a -peers value can be pasted
+as is. The files land where -tls-dir DIR expects them: DIR/ca.crt, and
+DIR/ID.crt and DIR/ID.key for each node. A client certificate lacks the
+member mark, so it can take locks through a node's LockService, as with
+mutex run -id NAME -tls-dir DIR, but cannot join the cluster.
+`
+
+// runCerts creates the certificates for running a cluster with mutual TLS,
+// without talking to anything but the local file system.
+func runCerts(args []string) {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		fmt.Fprint(os.Stderr, certsUsage)
+		os.Exit(2)
+	}
+	command, args := args[0], args[1:]
+
+	fs := flag.NewFlagSet("certs "+command, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), certsUsage+"\n")
+		fs.PrintDefaults()
+	}
+	var (
+		dir    = fs.String("dir", "certs", "Directory of the CA and node certificates, as given to -tls-dir")
+		days   = fs.Int("days", 0, "Validity in days; default 3650 for the CA and 365 for nodes")
+		force  = fs.Bool("force", false, "Overwrite existing files")
+		client = fs.Bool("client", false, "Issue client certificates for LockService instead of node certificates")
+	)
+	fs.Parse(args)
+
+	var err error
+	switch command {
+	case "init":
+		err = initCA(*dir, *days, *force)
+	case "issue":
+		if fs.NArg() == 0 {
+			fs.Usage()
+			os.Exit(2)
+		}
+		err = issueCerts(*dir, fs.Args(), *client, *days, *force)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown certs command %q\n\n%s", command, certsUsage)
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatalf("Failed to %s certificates: %v", command, err)
+	}
+}
+
+// initCA creates a self-signed CA certificate and its key in dir.
+func initCA(dir string, days int, force bool) error {
+	if days == 0 {
+		days = 3650
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	template, err := certTemplate("mutex cluster CA", days)
+	if err != nil {
+		return err
+	}
+	template.IsCA = true
+	template.BasicConstraintsValid = true
+	template.MaxPathLenZero = true
+	template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	keyPath, certPath := filepath.Join(dir, "ca.key"), filepath.Join(dir, "ca.crt")
+	if err := checkAbsent(force, keyPath, certPath); err != nil {
+		return err
+	}
+	if err := writeKey(keyPath, key, force); err != nil {
+		return err
+	}
+	return writeCert(certPath, der, force)
+}
+
+// issueCerts issues a certificate and key for each of nodes, signed by the
+// CA in dir. The node ID is the subject common name, which is what nodes
+// check against the node_id of every message, and MemberOU marks the
+// certificate as a member's. With client set, nodes are the names of
+// LockService clients instead, whose certificates only authenticate a
+// client and carry no member mark.
+func issueCerts(dir string, nodes []string, client bool, days int, force bool) error {
+	if days == 0 {
+		days = 365
+	}
+	ca, caKey, err := loadCA(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, arg := range nodes {
+		for _, node := range strings.Split(arg, ",") {
+			if node == "" {
+				continue
+			}
+			id, addr, _ := strings.Cut(node, "@")
+			if id == "" || strings.ContainsAny(id, `/\`) {
+				return fmt.Errorf("invalid node ID in %q", node)
+			}
+			if id == "ca" {
+				// Its files would be the CA's own.
+				return errors.New("ca is reserved for the CA")
+			}
+			hosts := []string{id}
+			if client {
+				if addr != "" {
+					return fmt.Errorf("client %s takes no address", id)
+				}
+				hosts = nil
+			}
+			if addr != "" {
+				host, _, err := net.SplitHostPort(addr)
+				if err != nil {
+					return fmt.Errorf("invalid address in %q: %v", node, err)
+				}
+				hosts = append(hosts, host)
+			}
+			if err := issueCert(dir, id, hosts, client, ca, caKey, days, force); err != nil {
+				return fmt.Errorf("%s: %v", id, err)
+			}
+		}
+	}
+	return nil
+}
+
+func issueCert(dir, id string, hosts []string, client bool, ca *x509.Certificate, caKey any, days int, force bool) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	template, err := certTemplate(id, days)
+	if err != nil {
+		return err
+	}
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	if client {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	} else {
+		template.Subject.OrganizationalUnit = []string{peer.MemberOU}
+		// Every node is both a server and a client of its peers.
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return err
+	}
+
+	keyPath, certPath := filepath.Join(dir, id+".key"), filepath.Join(dir, id+".crt")
+	if err := checkAbsent(force, keyPath, certPath); err != nil {
+		return err
+	}
+	if err := writeKey(keyPath, key, force); err != nil {
+		return err
+	}
+	return writeCert(certPath, der, force)
+}
+
+// certTemplate returns the fields every certificate shares, valid for days
+// from an hour ago so that slightly slow clocks accept it at once.
+func certTemplate(commonName string, days int) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.AddDate(0, 0, days),
+	}, nil
+}
+
+// loadCA reads the CA certificate and key that initCA wrote to dir.
+func loadCA(dir string) (*x509.Certificate, any, error) {
+	certPEM, err := os.ReadFile(filepath.Join(dir, "ca.crt"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("%v; run mutex certs init first", err)
+	}
+	keyPEM, err := os.ReadFile(filepath.Join(dir, "ca.key"))
+	if err != nil {
+		return nil, nil, err
+	}
+	certBlock, _ := pem.Decode(certPEM)
+	keyBlock, _ := pem.Decode(keyPEM)
+	if certBlock == nil || keyBlock == nil {
+		return nil, nil, errors.New("CA certificate or key is not PEM")
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+func writeKey(path string, key *ecdsa.PrivateKey, force bool) error {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	return writePEM(path, "PRIVATE KEY", der, 0o600, force)
+}
+
+func writeCert(path string, der []byte, force bool) error {
+	return writePEM(path, "CERTIFICATE", der, 0o644, force)
+}
+
+// checkAbsent fails if any of paths exists, unless force is set, so that a
+// key is never left behind without its certificate or the other way round.
+func checkAbsent(force bool, paths ...string) error {
+	if force {
+		return nil
+	}
+	for _, path := range paths {
+		if _, err := os.Stat(path); err == nil {
+			return fmt.Errorf("%s already exists; use -force to replace it", path)
+		}
+	}
+	return nil
+}
+
+// writePEM writes one PEM block to path, refusing to replace an existing
+// file unless force is set.
+func writePEM(path, blockType string, der []byte, mode os.FileMode, force bool) error {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if force {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	f, err := os.OpenFile(path, flags, mode)
+	if errors.Is(err, os.ErrExist) {
+		return fmt.Errorf("%s already exists; use -force to replace it", path)
+	}
+	if err != nil {
+		return err
+	}
+	if err := pem.Encode(f, &pem.Block{Type: blockType, Bytes: der}); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	log.Printf("Wrote %s", path)
+	return nil
+}
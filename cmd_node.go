@@ -0,0 +1,207 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"log"
+	peer "mutex/peer"
+	pb "mutex/stc"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// nodeFlags are the flags of every command that runs a node of its own.
+type nodeFlags struct {
+	id   *string
+	addr *string
+	join *string
+
+	heartbeat      *time.Duration
+	failureTimeout *time.Duration
+	suspectPhi     *float64
+	leaseGrace     *time.Duration
+	algorithm      *string
+	tree           *string
+	vectorClock    *bool
+	clock          *string
+	walDir         *string
+
+	tlsCert *string
+	tlsKey  *string
+	tlsCA   *string
+	tlsDir  *string
+}
+
+func addNodeFlags(fs *flag.FlagSet) *nodeFlags {
+	return &nodeFlags{
+		id:   fs.String("id", "", "Node ID"),
+		addr: fs.String("addr", "", "Node address (host:port)"),
+		join: fs.String("join", "", "Address (host:port) of any member to join the cluster through"),
+
+		heartbeat:      fs.Duration("heartbeat", time.Second, "Interval between heartbeats to each peer"),
+		failureTimeout: fs.Duration("failure-timeout", 10*time.Second, "Silence after which a peer is considered dead"),
+		suspectPhi:     fs.Float64("suspect-phi", 8, "Phi accrual threshold above which a peer is suspected"),
+		leaseGrace:     fs.Duration("lease-grace", time.Second, "Extra time to wait on a lease holder beyond its lease"),
+		algorithm:      fs.String("algorithm", peer.AlgorithmRicartAgrawala, "Mutual exclusion algorithm, one of "+strings.Join(peer.Algorithms(), ", ")+"; the same on every node"),
+		tree:           fs.String("tree", "", "Spanning tree for raymond as comma-separated child=parent edges; default is a binary tree over the sorted node IDs"),
+		clock:          fs.String("clock", peer.ClockLamport, "Logical clock behind every timestamp: lamport, or hlc for hybrid logical clocks that also tell the wall-clock time; the same on every node"),
+		walDir:         fs.String("wal-dir", "", "Directory for a write-ahead log that lets the node restart without breaking its promises; empty keeps none"),
+		vectorClock:    fs.Bool("vector-clock", false, "Keep a vector clock, send it with every message and append it to every log line"),
+
+		tlsCert: fs.String("tls-cert", "", "PEM certificate naming the node ID as common name; enables mutual TLS with -tls-key and -tls-ca"),
+		tlsKey:  fs.String("tls-key", "", "PEM private key of -tls-cert"),
+		tlsCA:   fs.String("tls-ca", "", "PEM certificate of the CA that signs every member's certificate"),
+		tlsDir:  fs.String("tls-dir", "", "Directory with ca.crt, ID.crt and ID.key, for ID the value of -id; the other -tls flags override single files"),
+	}
+}
+
+// tlsConfig loads the certificates the flags name, or returns nil when TLS
+// is not asked for.
+func (f *nodeFlags) tlsConfig() (*tls.Config, error) {
+	cert, key, ca := *f.tlsCert, *f.tlsKey, *f.tlsCA
+	if dir := *f.tlsDir; dir != "" {
+		if *f.id == "" {
+			return nil, fmt.Errorf("-tls-dir needs -id to find the certificate")
+		}
+		cert = cmp.Or(cert, filepath.Join(dir, *f.id+".crt"))
+		key = cmp.Or(key, filepath.Join(dir, *f.id+".key"))
+		ca = cmp.Or(ca, filepath.Join(dir, "ca.crt"))
+	}
+	if cert == "" && key == "" && ca == "" {
+		return nil, nil
+	}
+	if cert == "" || key == "" || ca == "" {
+		return nil, fmt.Errorf("-tls-cert, -tls-key and -tls-ca must be given together")
+	}
+	return peer.LoadTLS(cert, key, ca)
+}
+
+// start creates the node, serves MutexService and LockService on its address
+// and starts its background work, which runs until ctx is done.
+func (f *nodeFlags) start(ctx context.Context) (*peer.Node, error) {
+	if *f.id == "" || *f.addr == "" {
+		return nil, fmt.Errorf("node ID and address are required")
+	}
+
+	n := peer.NewNode(*f.id, *f.addr)
+	n.Config.HeartbeatInterval = *f.heartbeat
+	n.Config.FailureTimeout = *f.failureTimeout
+	n.Config.SuspectPhi = *f.suspectPhi
+	n.Config.LeaseGrace = *f.leaseGrace
+	n.Config.Algorithm = *f.algorithm
+	n.Config.Clock = *f.clock
+	n.Config.VectorClock = *f.vectorClock
+	n.Config.WALDir = *f.walDir
+	tlsConfig, err := f.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	n.Config.TLS = tlsConfig
+	if *f.tree != "" {
+		n.Config.Tree = make(map[string]string)
+		for _, edge := range strings.Split(*f.tree, ",") {
+			child, parent, ok := strings.Cut(edge, "=")
+			if !ok {
+				return nil, fmt.Errorf("invalid tree edge %q, want child=parent", edge)
+			}
+			n.Config.Tree[child] = parent
+		}
+	}
+
+	// Start gRPC server
+	lis, err := net.Listen("tcp", *f.addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen: %v", err)
+	}
+
+	grpcServer := grpc.NewServer(n.ServerOptions()...)
+	pb.RegisterMutexServiceServer(grpcServer, n)
+	pb.RegisterLockServiceServer(grpcServer, peer.NewLockServer(n))
+	if err := n.Start(ctx); err != nil {
+		lis.Close()
+		return nil, err
+	}
+
+	go func() {
+		if err := grpcServer.Serve(lis); err != nil {
+			log.Fatalf("Failed to serve: %v", err)
+		}
+	}()
+	return n, nil
+}
+
+// runNode runs a cluster member that takes the demo lock in a loop until
+// interrupted.
+func runNode(args []string) {
+	fs := flag.NewFlagSet("node", flag.ExitOnError)
+	nf := addNodeFlags(fs)
+	var (
+		peers  = fs.String("peers", "", "Comma-separated list of peer addresses (id@host:port)")
+		lock   = fs.String("lock", peer.DefaultLock, "Name of the lock the demo loop takes")
+		shared = fs.Bool("shared", false, "Take the demo lock in shared (reader) mode")
+		k      = fs.Int("permits", 1, "Number of holders the demo lock admits at once (k-mutual exclusion)")
+		lease  = fs.Duration("lease", 0, "Lease on each hold of the demo lock; 0 holds until released")
+	)
+	fs.Parse(args)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	n, err := nf.start(ctx)
+	if err != nil {
+		log.Fatalf("Failed to start node: %v", err)
+	}
+
+	// Connect to peers
+	if *peers != "" {
+		for _, peer := range strings.Split(*peers, ",") {
+			parts := strings.Split(peer, "@")
+			if len(parts) != 2 {
+				log.Fatalf("Invalid peer format: %s", peer)
+			}
+			peerID, peerAddr := parts[0], parts[1]
+
+			// Wait a bit for other nodes to start
+			time.Sleep(time.Second * 2)
+			if err := n.ConnectToPeer(peerID, peerAddr); err != nil {
+				log.Printf("Failed to connect to peer %s: %v", peerID, err)
+			}
+		}
+	}
+
+	// Join through a seed, learning the rest of the members from it
+	if *nf.join != "" {
+		if err := n.JoinCluster(ctx, *nf.join); err != nil {
+			log.Fatalf("Failed to join cluster: %v", err)
+		}
+	}
+	n.Ready()
+
+	// Periodically request critical section access until interrupted
+	demo := n.Semaphore(*lock, *k).Leased(*lease).WithLock
+	if *shared {
+		demo = n.Semaphore(*lock, *k).Leased(*lease).WithSharedLock
+	}
+	for ctx.Err() == nil {
+		time.Sleep(1 * time.Second)
+		if err := demo(ctx, n.ExecuteCriticalSection); err != nil {
+			log.Printf("Node %s failed to run critical section: %v", n.ID, err)
+		}
+	}
+
+	leaveCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := n.LeaveCluster(leaveCtx); err != nil {
+		log.Printf("Node %s failed to leave cleanly: %v", n.ID, err)
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	peer "mutex/peer"
+	pb "mutex/stc"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// Exit codes of the run command when the command itself never ran.
+const (
+	exitLockFailed = 75  // EX_TEMPFAIL: the lock could not be taken
+	exitNotFound   = 127 // the command could not be started, as in sh
+)
+
+// hold is a lock taken by the run command, either through a node's
+// LockService or through a node embedded in the command.
+type hold struct {
+	token   string
+	release func() error
+	renew   func() error
+	lost    <-chan struct{} // closed if the lock is no longer held
+}
+
+// runCommand runs a command while holding a lock, like flock(1) across the
+// cluster, and returns the exit code of the command.
+func runCommand(args []string) int {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: mutex run [flags] -- COMMAND [ARGS...]\n\n")
+		fmt.Fprintf(fs.Output(), "Takes the lock through -node, or through a node of its own when -join is\ngiven, runs COMMAND and releases the lock when it exits.\n\n")
+		fs.PrintDefaults()
+	}
+	nf := addNodeFlags(fs)
+	var (
+		node    = fs.String("node", "localhost:5001", "Address of the node to take the lock through, unless -join is given")
+		lock    = fs.String("lock", peer.DefaultLock, "Name of the lock to hold while the command runs")
+		shared  = fs.Bool("shared", false, "Take the lock in shared (reader) mode")
+		k       = fs.Int("permits", 1, "Number of holders the lock admits at once (k-mutual exclusion)")
+		lease   = fs.Duration("lease", 0, "Lease on the hold, renewed while the command runs; 0 holds until it exits")
+		timeout = fs.Duration("timeout", 0, "Give up if the lock is not taken within this time; 0 waits forever")
+		try     = fs.Bool("try", false, "Give up at once if the lock is busy")
+	)
+	fs.Parse(args)
+	argv := fs.Args()
+	if len(argv) == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	mode := pb.LockMode_EXCLUSIVE
+	if *shared {
+		mode = pb.LockMode_SHARED
+	}
+
+	// Signals cancel the wait for the lock and are passed on to the command
+	// once it runs.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(sigs)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case sig := <-sigs:
+			log.Printf("Received %v while waiting for lock %s", sig, *lock)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	acquireCtx := ctx
+	if *timeout > 0 {
+		var cancelTimeout context.CancelFunc
+		acquireCtx, cancelTimeout = context.WithTimeout(ctx, *timeout)
+		defer cancelTimeout()
+	}
+
+	var h *hold
+	var err error
+	if *nf.join != "" {
+		h, err = acquireEmbedded(acquireCtx, nf, *lock, mode, *k, *lease, *try)
+	} else {
+		var tlsConfig *tls.Config
+		tlsConfig, err = nf.tlsConfig()
+		if err != nil {
+			log.Printf("Failed to set up TLS: %v", err)
+			return exitLockFailed
+		}
+		h, err = acquireRemote(acquireCtx, *node, peer.TransportCredentials(tlsConfig, ""), &pb.LockRequest{
+			Lock:      *lock,
+			Mode:      mode,
+			Permits:   uint32(*k),
+			LeaseMs:   uint64(lease.Milliseconds()),
+			TimeoutMs: uint64(timeout.Milliseconds()),
+			Try:       *try,
+			Client:    fmt.Sprintf("mutex run %s (pid %d)", argv[0], os.Getpid()),
+		})
+	}
+	if err != nil {
+		log.Printf("Failed to take lock %s: %v", *lock, err)
+		return exitLockFailed
+	}
+	cancel() // stop listening for signals before the command owns them
+	log.Printf("Holding lock %s (fencing token %s), running %v", *lock, h.token, argv)
+
+	defer func() {
+		if err := h.release(); err != nil {
+			log.Printf("Failed to release lock %s: %v", *lock, err)
+		}
+	}()
+
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(), "MUTEX_LOCK="+*lock, "MUTEX_FENCING_TOKEN="+h.token)
+	if err := cmd.Start(); err != nil {
+		log.Printf("Failed to start %s: %v", argv[0], err)
+		return exitNotFound
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	var renew <-chan time.Time
+	if *lease > 0 {
+		ticker := time.NewTicker(*lease / 3)
+		defer ticker.Stop()
+		renew = ticker.C
+	}
+	lost := h.lost
+	for {
+		select {
+		case sig := <-sigs:
+			cmd.Process.Signal(sig)
+		case <-renew:
+			if err := h.renew(); err != nil {
+				log.Printf("Failed to renew lease on lock %s: %v", *lock, err)
+			}
+		case <-lost:
+			log.Printf("Lost lock %s, terminating %s", *lock, argv[0])
+			cmd.Process.Signal(syscall.SIGTERM)
+			lost = nil
+		case err := <-exited:
+			return exitCode(err)
+		}
+	}
+}
+
+// acquireRemote takes the lock through the LockService of the node at addr.
+// The hold lasts as long as the Acquire stream.
+func acquireRemote(ctx context.Context, addr string, creds grpc.DialOption, req *pb.LockRequest) (*hold, error) {
+	conn, err := grpc.NewClient(addr, creds)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to node %s: %v", addr, err)
+	}
+	client := pb.NewLockServiceClient(conn)
+
+	// The stream outlives ctx, which only bounds the wait for the grant.
+	streamCtx, cancel := context.WithCancel(context.Background())
+	stop := context.AfterFunc(ctx, cancel)
+	stream, err := client.Acquire(streamCtx, req)
+	var event *pb.LockEvent
+	if err == nil {
+		event, err = stream.Recv()
+	}
+	if !stop() {
+		err = ctx.Err() // the stream, and with it any grant, was cancelled
+	}
+	if err == nil && !event.Granted {
+		err = fmt.Errorf("node %s did not grant the lock", addr)
+	}
+	if err != nil {
+		cancel()
+		conn.Close()
+		return nil, err
+	}
+
+	lost := make(chan struct{})
+	go func() {
+		defer close(lost)
+		for {
+			event, err := stream.Recv()
+			if err != nil || event.Lost {
+				return
+			}
+		}
+	}()
+
+	return &hold{
+		token: peer.FencingToken{Timestamp: event.FencingToken.GetLamportTimestamp(), NodeID: event.FencingToken.GetNodeId()}.String(),
+		release: func() error {
+			defer conn.Close()
+			defer cancel()
+			select {
+			case <-lost:
+				return nil // already reported, the session is gone
+			default:
+			}
+			_, err := client.Release(context.Background(), &pb.SessionRequest{SessionId: event.SessionId})
+			return err
+		},
+		renew: func() error {
+			_, err := client.Renew(context.Background(), &pb.SessionRequest{SessionId: event.SessionId})
+			return err
+		},
+		lost: lost,
+	}, nil
+}
+
+// acquireEmbedded joins the cluster with a node of its own and takes the lock
+// through it. Releasing also leaves the cluster again.
+func acquireEmbedded(ctx context.Context, nf *nodeFlags, name string, mode pb.LockMode, k int, lease time.Duration, try bool) (*hold, error) {
+	nodeCtx, stopNode := context.WithCancel(context.Background())
+	n, err := nf.start(nodeCtx)
+	if err != nil {
+		stopNode()
+		return nil, err
+	}
+	leave := func() {
+		leaveCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := n.LeaveCluster(leaveCtx); err != nil {
+			log.Printf("Node %s failed to leave cleanly: %v", n.ID, err)
+		}
+		stopNode()
+	}
+
+	if err := n.JoinCluster(ctx, *nf.join); err != nil {
+		leave()
+		return nil, fmt.Errorf("failed to join cluster: %v", err)
+	}
+	n.Ready()
+
+	l := n.Semaphore(name, k).Leased(lease)
+	switch {
+	case try && mode == pb.LockMode_SHARED:
+		err = l.TryAcquireShared()
+	case try:
+		err = l.TryAcquire()
+	case mode == pb.LockMode_SHARED:
+		err = l.AcquireShared(ctx)
+	default:
+		err = l.Acquire(ctx)
+	}
+	if err != nil {
+		leave()
+		return nil, err
+	}
+
+	token, err := l.Token()
+	if err != nil {
+		l.Release()
+		leave()
+		return nil, err
+	}
+	lost := l.Lost()
+	if lost == nil {
+		lost = make(chan struct{})
+	}
+	return &hold{
+		token: token.String(),
+		release: func() error {
+			defer leave()
+			err := l.Release()
+			if errors.Is(err, peer.ErrLeaseExpired) {
+				return nil // already reported through lost
+			}
+			return err
+		},
+		renew: l.Renew,
+		lost:  lost,
+	}, nil
+}
+
+// exitCode turns the result of cmd.Wait into an exit code for the run
+// command, mapping death by a signal to 128+signal like a shell does.
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			return 128 + int(ws.Signal())
+		}
+		return exitErr.ExitCode()
+	}
+	log.Printf("Failed to wait for command: %v", err)
+	return 1
+}
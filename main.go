@@ -1,66 +1,38 @@
 package main
 
 import (
-	"flag"
-	"log"
-	peer "mutex/peer"
-	pb "mutex/stc"
-	"net"
+	"fmt"
+	"os"
 	"strings"
-	"time"
-
-	"google.golang.org/grpc"
 )
 
-func main() {
-	var (
-		nodeID = flag.String("id", "", "Node ID")
-		addr   = flag.String("addr", "", "Node address (host:port)")
-		peers  = flag.String("peers", "", "Comma-separated list of peer addresses (id@host:port)")
-	)
-	flag.Parse()
-
-	if *nodeID == "" || *addr == "" {
-		log.Fatal("Node ID and address are required")
-	}
-
-	n := peer.NewNode(*nodeID, *addr)
+const usage = `Usage:
+  mutex [node] -id ID -addr HOST:PORT [flags]   run a cluster node
+  mutex run [flags] -- COMMAND [ARGS...]        run a command while holding a lock
+  mutex certs init|issue [flags] [NODE...]      create certificates for mutual TLS
 
-	// Start gRPC server
-	lis, err := net.Listen("tcp", *addr)
-	if err != nil {
-		log.Fatalf("Failed to listen: %v", err)
-	}
-
-	grpcServer := grpc.NewServer()
-	pb.RegisterMutexServiceServer(grpcServer, n)
-
-	go func() {
-		if err := grpcServer.Serve(lis); err != nil {
-			log.Fatalf("Failed to serve: %v", err)
-		}
-	}()
+Run "mutex COMMAND -h" for the flags of a command.
+`
 
-	// Connect to peers
-	if *peers != "" {
-		for _, peer := range strings.Split(*peers, ",") {
-			parts := strings.Split(peer, "@")
-			if len(parts) != 2 {
-				log.Fatalf("Invalid peer format: %s", peer)
-			}
-			peerID, peerAddr := parts[0], parts[1]
-
-			// Wait a bit for other nodes to start
-			time.Sleep(time.Second * 2)
-			if err := n.ConnectToPeer(peerID, peerAddr); err != nil {
-				log.Printf("Failed to connect to peer %s: %v", peerID, err)
-			}
-		}
+func main() {
+	// Plain flags without a command start a node, as they always have.
+	args := os.Args[1:]
+	command := "node"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
 	}
 
-	// Periodically request critical section access
-	for {
-		time.Sleep(1 * time.Second)
-		n.RequestCriticalSection()
+	switch command {
+	case "node":
+		runNode(args)
+	case "run":
+		os.Exit(runCommand(args))
+	case "certs":
+		runCerts(args)
+	case "help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n%s", command, usage)
+		os.Exit(2)
 	}
 }
@@ -0,0 +1,309 @@
+package peer
+
+import (
+	"context"
+	"fmt"
+	pb "mutex/stc"
+	"sort"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Names of the algorithms a node can run, for Config.Algorithm. Every node of
+// a cluster must run the same one.
+const (
+	AlgorithmRicartAgrawala    = "ricart-agrawala"
+	AlgorithmRoucairolCarvalho = "roucairol-carvalho"
+	AlgorithmSuzukiKasami      = "suzuki-kasami"
+	AlgorithmMaekawa           = "maekawa"
+	AlgorithmRaymond           = "raymond"
+	AlgorithmLamport           = "lamport"
+	AlgorithmCoordinator       = "coordinator"
+)
+
+// MutexAlgorithm decides when this node may enter the critical section of a
+// lock. The node around it serializes local callers per lock, issues fencing
+// tokens, runs leases and reports status, and carries the algorithm's
+// messages over the Deliver RPC (see Node.Post and Node.Send), so an
+// algorithm only has to implement the protocol itself. Every node of a
+// cluster must run the same algorithm.
+type MutexAlgorithm interface {
+	Name() string
+	// Request blocks until this node may enter the critical section of
+	// req.Lock, or fails once ctx is done. Release is called afterwards
+	// either way. Requests for one lock never overlap on a node.
+	Request(ctx context.Context, req *Request) error
+	// Release gives up the lock after Request, whether it succeeded or not.
+	Release(lock string)
+	// Handle processes a message a peer sent with Post or Send.
+	Handle(msg *pb.AlgorithmMessage)
+	// State describes what the algorithm is doing for lock, for Status, or
+	// returns "" if there is nothing worth reporting.
+	State(lock string) string
+	// Leave hands anything the cluster depends on to the other members
+	// before this node leaves. No lock is wanted or held at that point.
+	Leave()
+}
+
+// PeerRestartHandler is implemented by algorithms that keep state about
+// other nodes. PeerRestarted is called when peerID turns out to have
+// restarted, before any message of its new run is handled, to forget what its
+// previous run asked for or was promised.
+type PeerRestartHandler interface {
+	PeerRestarted(peerID string)
+}
+
+// PermissionAlgorithm is a MutexAlgorithm that asks the other nodes for
+// permission over the RequestAccess and ReleaseAccess RPCs instead of
+// Deliver, like NewRicartAgrawala and NewRoucairolCarvalho. A node only
+// serves those RPCs, and Withdraw and RenewLease, while its algorithm
+// implements this interface, so a wrapper around one of them has to pass
+// these methods on, along with PeerRestarted.
+type PermissionAlgorithm interface {
+	MutexAlgorithm
+	PeerRestartHandler
+	// HandleRequest answers a peer's request for permission.
+	HandleRequest(req *pb.AccessRequest) (*pb.AccessResponse, error)
+	// HandleRelease credits a peer's reply to a request of ours.
+	HandleRelease(req *pb.ReleaseRequest) *pb.ReleaseResponse
+}
+
+// Request is one attempt of this node to enter the critical section of a
+// lock.
+type Request struct {
+	Lock      string
+	ID        uint64 // unique per node, reused by nothing else
+	Timestamp uint64 // Lamport clock when the request was made
+	Mode      pb.LockMode
+	Permits   int           // k for a k-mutual exclusion lock, 1 for a plain mutex
+	Lease     time.Duration // lease of the hold, 0 if none
+	Try       bool          // fail with ErrWouldBlock rather than wait for other nodes
+}
+
+// exclusiveOnly fails req with ErrUnsupported unless it is a plain exclusive
+// request, the only kind the token and quorum algorithms handle.
+func exclusiveOnly(req *Request) error {
+	if req.Mode != pb.LockMode_EXCLUSIVE || req.Permits > 1 || req.Lease > 0 {
+		return ErrUnsupported
+	}
+	return nil
+}
+
+var (
+	algorithmsMu sync.Mutex
+	algorithms   = map[string]func(*Node) (MutexAlgorithm, error){
+		AlgorithmRicartAgrawala:    newRicartAgrawala,
+		AlgorithmRoucairolCarvalho: newRoucairolCarvalho,
+		AlgorithmSuzukiKasami:      newSuzukiKasami,
+		AlgorithmMaekawa:           newMaekawa,
+		AlgorithmRaymond:           newRaymond,
+		AlgorithmLamport:           newLamport,
+		AlgorithmCoordinator:       newCoordinator,
+	}
+)
+
+// RegisterAlgorithm makes an algorithm available under name for
+// Config.Algorithm, e.g. an instrumented variant or a test double. The
+// factory is called by Start.
+func RegisterAlgorithm(name string, factory func(*Node) (MutexAlgorithm, error)) {
+	algorithmsMu.Lock()
+	defer algorithmsMu.Unlock()
+	algorithms[name] = factory
+}
+
+// Algorithms lists the names Config.Algorithm accepts.
+func Algorithms() []string {
+	algorithmsMu.Lock()
+	defer algorithmsMu.Unlock()
+	names := make([]string, 0, len(algorithms))
+	for name := range algorithms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// algorithm returns the algorithm set up by Start, or nil before Start.
+func (n *Node) algorithm() MutexAlgorithm {
+	select {
+	case <-n.started:
+		return n.algo
+	default:
+		return nil
+	}
+}
+
+// errNotStarted is what RPCs that need the algorithm answer before Start.
+func (n *Node) errNotStarted() error {
+	return status.Errorf(codes.Unavailable, "node %s has not started", n.ID)
+}
+
+func newAlgorithm(n *Node) (MutexAlgorithm, error) {
+	name := n.Config.Algorithm
+	if name == "" {
+		name = AlgorithmRicartAgrawala
+	}
+	algorithmsMu.Lock()
+	factory, ok := algorithms[name]
+	algorithmsMu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown algorithm %q", name)
+	}
+	return factory(n)
+}
+
+// --- Server functions ---
+func (n *Node) Deliver(ctx context.Context, msg *pb.AlgorithmMessage) (*pb.AlgorithmAck, error) {
+	algo := n.algorithm()
+	if algo == nil {
+		return nil, n.errNotStarted()
+	}
+	if !n.isReady() {
+		return nil, status.Errorf(codes.Unavailable, "node %s is not ready", n.ID)
+	}
+	if algo.Name() != msg.Algorithm {
+		return nil, fmt.Errorf("node %s runs %s, not %s", n.ID, algo.Name(), msg.Algorithm)
+	}
+	if err := n.checkIncarnation(msg.NodeId, msg.Incarnation); err != nil {
+		return nil, err
+	}
+	n.UpdateLamportClock(msg.LamportTimestamp)
+	n.mergeVector(msg.VectorClock)
+	n.logf("Node %s received %s from %s for lock %s with %s", n.ID, msg.Kind, msg.NodeId, msg.Lock, n.stamp(msg.LamportTimestamp))
+	algo.Handle(msg)
+	return &pb.AlgorithmAck{}, nil
+}
+
+// --- client functions ---
+
+// Send delivers msg to peerID, retrying until it arrives or the peer is dead
+// or no longer a member. The node fills in the sender, algorithm and Lamport
+// timestamp.
+func (n *Node) Send(peerID string, msg *pb.AlgorithmMessage) error {
+	msg.Algorithm = n.algo.Name()
+	msg.NodeId = n.ID
+	msg.LamportTimestamp = n.GetLamportClock()
+	msg.VectorClock = n.tickVector()
+	msg.Incarnation = n.Incarnation
+	n.countMessages(1, 0)
+	for {
+		n.PeerMu.RLock()
+		client := n.Peers[peerID]
+		n.PeerMu.RUnlock()
+		if client == nil {
+			return fmt.Errorf("peer %s is not a member", peerID)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), n.Config.FailureTimeout)
+		_, err := client.Deliver(ctx, msg)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		n.logf("Error sending %s to %s: %v", msg.Kind, peerID, err)
+
+		if n.PeerState(peerID) == PeerDead {
+			return fmt.Errorf("peer %s is dead", peerID)
+		}
+		time.Sleep(n.Config.HeartbeatInterval)
+	}
+}
+
+// Post queues msg for peerID, which may be this node itself. Messages posted
+// to the same node arrive in the order they were posted, like on the FIFO
+// channels the quorum algorithms assume; a message that cannot be delivered is
+// dropped.
+func (n *Node) Post(peerID string, msg *pb.AlgorithmMessage) {
+	n.outboxMu.Lock()
+	outbox, ok := n.outbox[peerID]
+	if !ok {
+		outbox = make(chan *pb.AlgorithmMessage, 64)
+		n.outbox[peerID] = outbox
+		go n.drainOutbox(peerID, outbox)
+	}
+	n.outboxMu.Unlock()
+	outbox <- msg
+}
+
+func (n *Node) drainOutbox(peerID string, outbox <-chan *pb.AlgorithmMessage) {
+	for msg := range outbox {
+		if peerID == n.ID {
+			msg.Algorithm = n.algo.Name()
+			msg.NodeId = n.ID
+			msg.LamportTimestamp = n.GetLamportClock()
+			n.algo.Handle(msg)
+			continue
+		}
+		if err := n.Send(peerID, msg); err != nil {
+			n.logf("Gave up sending %s to %s: %v", msg.Kind, peerID, err)
+		}
+	}
+}
+
+// broadcast delivers a copy of msg to every live peer in the background.
+func (n *Node) broadcast(msg *pb.AlgorithmMessage) {
+	for id := range n.livePeers() {
+		go func(id string, msg *pb.AlgorithmMessage) {
+			if err := n.Send(id, msg); err != nil {
+				n.logf("Gave up sending %s to %s: %v", msg.Kind, id, err)
+			}
+		}(id, &pb.AlgorithmMessage{Kind: msg.Kind, Lock: msg.Lock, Sequence: msg.Sequence})
+	}
+}
+
+// memberIDs returns the IDs of every known member, this node included.
+func (n *Node) memberIDs() []string {
+	n.PeerMu.RLock()
+	defer n.PeerMu.RUnlock()
+
+	ids := []string{n.ID}
+	for id := range n.Peers {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// Ready tells the node that it knows its initial members: every peer it was
+// configured with is connected, or JoinCluster has returned. Token-based
+// algorithms decide from those members, once, which node starts out with the
+// tokens, and AlgorithmRaymond builds its tree over them. Deliver refuses
+// messages until then, which their senders retry, and Acquire fails with
+// ErrNotReady. It is called after Start; calling it again has no effect.
+func (n *Node) Ready() {
+	n.readyOnce.Do(func() {
+		n.initialMembers = n.memberIDs()
+		n.PeerMu.RLock()
+		n.founding = !n.joined
+		for id, info := range n.peerInfo {
+			if !info.joined && id < n.ID {
+				n.founding = false
+			}
+		}
+		n.PeerMu.RUnlock()
+		if n.founding {
+			n.logf("Node %s is the founding member", n.ID)
+		}
+		close(n.ready)
+	})
+}
+
+// isReady reports whether Ready has been called.
+func (n *Node) isReady() bool {
+	select {
+	case <-n.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// founder reports whether this node starts out with the tokens of
+// token-based algorithms: the member with the smallest ID among those that
+// did not join a running cluster, as nodes that join find the tokens already
+// in circulation. It is decided by Ready, and only meaningful after it.
+func (n *Node) founder() bool {
+	return n.founding
+}
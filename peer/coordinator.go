@@ -0,0 +1,321 @@
+package peer
+
+import (
+	"context"
+	"fmt"
+	pb "mutex/stc"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Kinds of coordinator messages. Sequence carries the request ID a REQUEST,
+// GRANT, RELEASE or HOLDING is about.
+const (
+	coRequest     = "REQUEST"     // member to coordinator: queue my request
+	coGrant       = "GRANT"       // coordinator to member: your request may enter
+	coRelease     = "RELEASE"     // member to coordinator: done, or no longer interested
+	coHolding     = "HOLDING"     // member to new coordinator: I hold the lock
+	coSynced      = "SYNCED"      // member to new coordinator: that was all I have
+	coElection    = "ELECTION"    // to every higher member: I am looking for a coordinator
+	coAnswer      = "ANSWER"      // to a lower member: I am alive and will take over the election
+	coCoordinator = "COORDINATOR" // to every member: I am the coordinator now
+)
+
+// coordinator is the centralized algorithm. One member, the coordinator,
+// keeps a FIFO queue per lock and grants the lock to one member at a time,
+// so an entry costs 3 messages: REQUEST, GRANT and RELEASE. The coordinator
+// is chosen with the Bully algorithm, so the live member with the highest ID
+// wins. A new coordinator rebuilds its queues from the members, which report
+// what they hold and request before it grants anything. Requires exclusive
+// mode, one permit and no lease.
+type coordinator struct {
+	n        *Node
+	mu       sync.Mutex      // guards everything below
+	leader   string          // the coordinator, "" while unknown
+	electing bool            // an election we started is running
+	answered bool            // a higher member answered our ELECTION
+	round    uint64          // bumped on every election step, to ignore stale timers
+	syncing  map[string]bool // members a new coordinator waits for before granting, nil when serving
+	tending  bool            // tend is scheduled
+	locks    map[string]*coLock
+}
+
+// coEntry is a request as queued by the coordinator.
+type coEntry struct {
+	node string
+	id   uint64
+}
+
+// coLock is the coordinator state of one lock, both as a member and, on the
+// coordinator, as the server of the lock.
+type coLock struct {
+	request uint64 // ID of our own request, 0 if there is none
+	granted bool
+	waiting chan struct{} // closed once request is granted
+
+	holder *coEntry  // request holding the lock, on the coordinator
+	queue  []coEntry // requests waiting for it in arrival order, on the coordinator
+}
+
+// coMessage is a message to post once mu is released.
+type coMessage struct {
+	to   string
+	kind string
+	lock string
+	id   uint64
+}
+
+func newCoordinator(n *Node) (MutexAlgorithm, error) {
+	return &coordinator{n: n, locks: make(map[string]*coLock)}, nil
+}
+
+func (c *coordinator) Name() string {
+	return AlgorithmCoordinator
+}
+
+// lock returns the state of name, creating it on first use. Must be called
+// with mu held.
+func (c *coordinator) lock(name string) *coLock {
+	s, ok := c.locks[name]
+	if !ok {
+		s = &coLock{}
+		c.locks[name] = s
+	}
+	return s
+}
+
+func (c *coordinator) Request(ctx context.Context, req *Request) error {
+	if err := exclusiveOnly(req); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	s := c.lock(req.Lock)
+	s.request = req.ID
+	s.granted = false
+	waiting := make(chan struct{})
+	s.waiting = waiting
+	// Without a coordinator the request is sent once one is elected.
+	out := c.toLeader(coRequest, req.Lock, req.ID)
+	c.mu.Unlock()
+	c.post(out)
+	c.watch()
+
+	watch := time.NewTicker(c.n.Config.HeartbeatInterval)
+	defer watch.Stop()
+	for {
+		select {
+		case <-waiting:
+			return nil
+		case <-watch.C:
+			c.watch()
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Release gives the lock back to the coordinator, or takes our request out
+// of its queue if it was not granted yet.
+func (c *coordinator) Release(name string) {
+	c.mu.Lock()
+	s := c.lock(name)
+	id := s.request
+	s.request = 0
+	s.granted = false
+	s.waiting = nil
+	var out []coMessage
+	if id != 0 {
+		out = c.toLeader(coRelease, name, id)
+	}
+	c.mu.Unlock()
+	c.post(out)
+}
+
+func (c *coordinator) Handle(msg *pb.AlgorithmMessage) {
+	c.mu.Lock()
+	out := c.receive(msg.NodeId, msg.Kind, msg.Lock, msg.Sequence)
+	c.mu.Unlock()
+	c.post(out)
+}
+
+// receive processes one message, which may come from this node itself when
+// it is the coordinator. Must be called with mu held.
+func (c *coordinator) receive(from, kind, name string, id uint64) []coMessage {
+	entry := coEntry{node: from, id: id}
+	switch kind {
+	case coRequest, coHolding, coRelease:
+		if c.leader != c.n.ID {
+			// Meant for an earlier term; the member sends it again once it
+			// hears of the new coordinator.
+			c.n.logf("Node %s dropping %s from %s: not the coordinator", c.n.ID, kind, from)
+			return nil
+		}
+		s := c.lock(name)
+		switch kind {
+		case coRequest:
+			if (s.holder == nil || *s.holder != entry) && !slices.Contains(s.queue, entry) {
+				s.queue = append(s.queue, entry)
+			}
+		case coHolding:
+			if s.holder != nil && *s.holder != entry {
+				c.n.logf("Node %s told by both %s and %s that they hold lock %s", c.n.ID, s.holder.node, from, name)
+			}
+			s.holder = &entry
+			s.queue = slices.DeleteFunc(s.queue, func(e coEntry) bool { return e == entry })
+		case coRelease:
+			if s.holder != nil && *s.holder == entry {
+				s.holder = nil
+			}
+			s.queue = slices.DeleteFunc(s.queue, func(e coEntry) bool { return e == entry })
+		}
+		return c.grantNext(name, s)
+	case coSynced:
+		if c.leader != c.n.ID || c.syncing == nil {
+			return nil
+		}
+		delete(c.syncing, from)
+		return c.finishSync()
+	case coGrant:
+		// A grant from a deposed coordinator would not be known to the new
+		// one, so it is not taken.
+		if from != c.leader {
+			c.n.logf("Node %s ignoring grant of lock %s from %s: the coordinator is %q", c.n.ID, name, from, c.leader)
+			return nil
+		}
+		c.grant(c.lock(name), id)
+	case coElection:
+		out := []coMessage{{to: from, kind: coAnswer}}
+		if c.leader == c.n.ID {
+			// Still here: the member only needs to hear who coordinates.
+			return append(out, coMessage{to: from, kind: coCoordinator})
+		}
+		return append(out, c.elect()...)
+	case coAnswer:
+		if c.electing {
+			c.answered = true
+		}
+	case coCoordinator:
+		return c.follow(from)
+	default:
+		c.n.logf("Node %s ignoring unknown %s message %s", c.n.ID, c.Name(), kind)
+	}
+	return nil
+}
+
+// grantNext hands the lock to the head of the queue if nobody holds it and
+// the coordinator is serving. Must be called with mu held.
+func (c *coordinator) grantNext(name string, s *coLock) []coMessage {
+	if c.syncing != nil || s.holder != nil || len(s.queue) == 0 {
+		return nil
+	}
+	next := s.queue[0]
+	s.queue = s.queue[1:]
+	s.holder = &next
+	c.n.logf("Node %s granting lock %s to %s (request %d)", c.n.ID, name, next.node, next.id)
+	if next.node == c.n.ID {
+		c.grant(s, next.id)
+		return nil
+	}
+	return []coMessage{{to: next.node, kind: coGrant, lock: name, id: next.id}}
+}
+
+// grant lets our request id in, unless we gave it up meanwhile. Must be
+// called with mu held.
+func (c *coordinator) grant(s *coLock, id uint64) {
+	if s.request == id && !s.granted {
+		s.granted = true
+		close(s.waiting)
+	}
+}
+
+// toLeader sends a message about our own request to the coordinator, which
+// may be this node. Must be called with mu held.
+func (c *coordinator) toLeader(kind, name string, id uint64) []coMessage {
+	switch c.leader {
+	case "":
+		return nil
+	case c.n.ID:
+		return c.receive(c.n.ID, kind, name, id)
+	default:
+		return []coMessage{{to: c.leader, kind: kind, lock: name, id: id}}
+	}
+}
+
+// watch starts an election if there is no coordinator or it died.
+func (c *coordinator) watch() {
+	c.mu.Lock()
+	if c.leader != "" && c.leader != c.n.ID && c.n.PeerState(c.leader) == PeerDead {
+		c.n.logf("Node %s lost coordinator %s", c.n.ID, c.leader)
+		c.leader = ""
+	}
+	var out []coMessage
+	if c.leader == "" {
+		out = c.elect()
+	}
+	c.mu.Unlock()
+	c.post(out)
+}
+
+func (c *coordinator) post(out []coMessage) {
+	for _, m := range out {
+		c.n.Post(m.to, &pb.AlgorithmMessage{Kind: m.kind, Lock: m.lock, Sequence: m.id})
+	}
+}
+
+func (c *coordinator) State(name string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s, ok := c.locks[name]
+	if !ok {
+		return ""
+	}
+	state := fmt.Sprintf("coordinator %q", c.leader)
+	switch {
+	case c.leader == c.n.ID && c.syncing != nil:
+		state += fmt.Sprintf(", waiting for %d members to report", len(c.syncing))
+	case c.leader == c.n.ID && s.holder != nil:
+		state += fmt.Sprintf(", held by %s, %d queued", s.holder.node, len(s.queue))
+	case c.leader == c.n.ID:
+		state += fmt.Sprintf(", %d queued", len(s.queue))
+	}
+	if s.request != 0 && !s.granted {
+		state += ", waiting for a grant"
+	}
+	return state
+}
+
+// PeerRestarted treats the previous run of peerID like a dead member. As the
+// coordinator we take its requests out of the queues, including one holding a
+// lock. If it was our coordinator, it forgot its queues, so we look for one
+// again as if it had died.
+func (c *coordinator) PeerRestarted(peerID string) {
+	c.mu.Lock()
+	var out []coMessage
+	if c.leader == c.n.ID {
+		if c.syncing[peerID] {
+			delete(c.syncing, peerID)
+			out = append(out, c.finishSync()...)
+		}
+		old := func(e coEntry) bool { return e.node == peerID }
+		for name, s := range c.locks {
+			s.queue = slices.DeleteFunc(s.queue, old)
+			if s.holder != nil && old(*s.holder) {
+				c.n.logf("Node %s taking lock %s back from restarted member %s", c.n.ID, name, peerID)
+				s.holder = nil
+				out = append(out, c.grantNext(name, s)...)
+			}
+		}
+	}
+	if c.leader == peerID {
+		c.n.logf("Node %s lost coordinator %s", c.n.ID, peerID)
+		c.leader = ""
+	}
+	c.mu.Unlock()
+	c.post(out)
+}
+
+// Leave has nothing to hand over: when we were the coordinator, the members
+// elect a new one as soon as they need it.
+func (c *coordinator) Leave() {}
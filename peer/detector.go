@@ -0,0 +1,255 @@
+package peer
+
+import (
+	"context"
+	"fmt"
+	"math"
+	pb "mutex/stc"
+	"path/filepath"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// PeerState is what the failure detector currently believes about a peer.
+type PeerState int
+
+const (
+	PeerAlive     PeerState = iota
+	PeerSuspected           // phi crossed Config.SuspectPhi; still asked for permission
+	PeerDead                // silent for Config.FailureTimeout; excluded from new and pending requests
+)
+
+func (s PeerState) String() string {
+	switch s {
+	case PeerSuspected:
+		return "suspected"
+	case PeerDead:
+		return "dead"
+	default:
+		return "alive"
+	}
+}
+
+// peerInfo is the per-peer bookkeeping kept next to the client in Node.Peers.
+type peerInfo struct {
+	address  string
+	conn     *grpc.ClientConn
+	state    PeerState
+	detector *phiDetector
+	joined   bool // joined a running cluster rather than being configured from the start
+
+	incarnation uint64 // latest run of the peer heard from, 0 before the first message
+}
+
+// maxHeartbeatSamples bounds the window of inter-arrival times used for phi.
+const maxHeartbeatSamples = 100
+
+// phiDetector is a phi accrual failure detector (Hayashibara et al.). Instead
+// of a yes/no answer it reports how unlikely the current silence is given the
+// heartbeat inter-arrival times seen so far.
+type phiDetector struct {
+	intervals []float64 // milliseconds
+	last      time.Time
+}
+
+func newPhiDetector(expected time.Duration, now time.Time) *phiDetector {
+	// Seed the window with the expected interval so phi is meaningful before
+	// the first real heartbeat arrives.
+	return &phiDetector{
+		intervals: []float64{float64(expected.Milliseconds())},
+		last:      now,
+	}
+}
+
+func (d *phiDetector) heartbeat(now time.Time) {
+	d.intervals = append(d.intervals, float64(now.Sub(d.last).Milliseconds()))
+	if len(d.intervals) > maxHeartbeatSamples {
+		d.intervals = d.intervals[1:]
+	}
+	d.last = now
+}
+
+func (d *phiDetector) phi(now time.Time) float64 {
+	var sum, sumSq float64
+	for _, v := range d.intervals {
+		sum += v
+		sumSq += v * v
+	}
+	count := float64(len(d.intervals))
+	mean := sum / count
+	std := math.Sqrt(math.Max(sumSq/count-mean*mean, 0))
+	// A perfectly regular sender would make any delay look infinitely
+	// unlikely, so never trust a deviation below a quarter of the mean.
+	std = math.Max(std, mean/4)
+
+	elapsed := float64(now.Sub(d.last).Milliseconds())
+	// Logistic approximation of the normal CDF, as used by Akka and Cassandra.
+	y := (elapsed - mean) / std
+	e := math.Exp(-y * (1.5976 + 0.070566*y*y))
+	if elapsed > mean {
+		return -math.Log10(e / (1 + e))
+	}
+	return -math.Log10(1 - 1/(1+e))
+}
+
+// --- Server functions ---
+func (n *Node) Heartbeat(ctx context.Context, req *pb.HeartbeatRequest) (*pb.HeartbeatResponse, error) {
+	if n.algorithm() == nil {
+		return nil, n.errNotStarted()
+	}
+	if err := n.checkIncarnation(req.NodeId, req.Incarnation); err != nil {
+		return nil, err
+	}
+	n.recordHeartbeat(req.NodeId)
+	return &pb.HeartbeatResponse{NodeId: n.ID, Incarnation: n.Incarnation}, nil
+}
+
+// --- failure detection ---
+
+// Start sets up the configured algorithm and runs the background work of the
+// node until ctx is done. A node is brought up in this order: NewNode, then
+// changes to Config, registering it with a gRPC server created with
+// ServerOptions, Start, connecting to the peers with ConnectToPeer or
+// JoinCluster, and finally Ready. The server may serve before Start; the
+// calls that need the algorithm fail with codes.Unavailable until then.
+// Start must be called only once.
+func (n *Node) Start(ctx context.Context) error {
+	switch n.Config.Clock {
+	case "", ClockLamport, ClockHLC:
+	default:
+		return fmt.Errorf("unknown clock %q", n.Config.Clock)
+	}
+	algo, err := newAlgorithm(n)
+	if err != nil {
+		return err
+	}
+	n.algo = algo
+	if n.Config.WALDir != "" {
+		w, err := openWAL(filepath.Join(n.Config.WALDir, n.ID+".wal"))
+		if err != nil {
+			return fmt.Errorf("failed to open write-ahead log: %v", err)
+		}
+		n.wal = w
+		n.recover()
+	}
+	if err := n.startIncarnation(); err != nil {
+		return err
+	}
+	if n.wal != nil {
+		go n.answerRecovered(ctx)
+	}
+	// Only now, with the promises of a previous run restored, may peers
+	// reach the algorithm.
+	close(n.started)
+	go n.heartbeatLoop(ctx)
+	return nil
+}
+
+func (n *Node) heartbeatLoop(ctx context.Context) {
+	ticker := time.NewTicker(n.Config.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		n.PeerMu.RLock()
+		clients := make(map[string]pb.MutexServiceClient, len(n.Peers))
+		for id, client := range n.Peers {
+			clients[id] = client
+		}
+		n.PeerMu.RUnlock()
+
+		for id, client := range clients {
+			go func(id string, c pb.MutexServiceClient) {
+				hbCtx, cancel := context.WithTimeout(ctx, n.Config.HeartbeatInterval)
+				defer cancel()
+				resp, err := c.Heartbeat(hbCtx, &pb.HeartbeatRequest{NodeId: n.ID, Incarnation: n.Incarnation})
+				if err == nil && n.checkIncarnation(id, resp.Incarnation) == nil {
+					n.recordHeartbeat(id)
+				}
+			}(id, client)
+		}
+
+		n.checkPeers()
+	}
+}
+
+// recordHeartbeat notes a sign of life from peerID, which is either an answered
+// ping or an incoming ping.
+func (n *Node) recordHeartbeat(peerID string) {
+	n.PeerMu.Lock()
+	info, ok := n.peerInfo[peerID]
+	if !ok {
+		n.PeerMu.Unlock()
+		return
+	}
+	info.detector.heartbeat(time.Now())
+	previous := info.state
+	info.state = PeerAlive
+	n.PeerMu.Unlock()
+
+	if previous != PeerAlive {
+		n.logf("Node %s sees peer %s alive again (was %s)", n.ID, peerID, previous)
+	}
+}
+
+// checkPeers moves peers between alive, suspected and dead and drops newly
+// dead peers from the request in progress.
+func (n *Node) checkPeers() {
+	now := time.Now()
+	var died []string
+
+	n.PeerMu.Lock()
+	for id, info := range n.peerInfo {
+		phi := info.detector.phi(now)
+		silence := now.Sub(info.detector.last)
+
+		switch {
+		case silence >= n.Config.FailureTimeout:
+			if info.state != PeerDead {
+				n.logf("Node %s declares peer %s dead after %v without heartbeat", n.ID, id, silence.Round(time.Millisecond))
+				info.state = PeerDead
+				died = append(died, id)
+			}
+		case phi >= n.Config.SuspectPhi:
+			if info.state == PeerAlive {
+				n.logf("Node %s suspects peer %s (phi %.1f)", n.ID, id, phi)
+				info.state = PeerSuspected
+			}
+		}
+	}
+	n.PeerMu.Unlock()
+
+	for _, id := range died {
+		n.excludePeer(id)
+	}
+}
+
+// excludePeer stops waiting for peerID in the request in progress. Replies we
+// owe a dead peer stay queued; sending them just fails if it is really gone.
+func (n *Node) excludePeer(peerID string) {
+	n.ReqMu.Lock()
+	defer n.ReqMu.Unlock()
+
+	for _, ls := range n.locks {
+		if ls.round != nil && ls.round.pending[peerID] {
+			n.logf("Node %s no longer waiting for %s on request %d for lock %s", n.ID, peerID, ls.round.requestID, ls.name)
+			ls.round.drop(peerID)
+		}
+	}
+}
+
+// PeerState reports the failure detector's view of peerID.
+func (n *Node) PeerState(peerID string) PeerState {
+	n.PeerMu.RLock()
+	defer n.PeerMu.RUnlock()
+	if info, ok := n.peerInfo[peerID]; ok {
+		return info.state
+	}
+	return PeerDead
+}
@@ -0,0 +1,166 @@
+package peer
+
+import (
+	"slices"
+	"time"
+)
+
+// elect runs the Bully algorithm: ask every live member with a higher ID to
+// take over, and become the coordinator if none of them answers. Must be
+// called with mu held.
+func (c *coordinator) elect() []coMessage {
+	if c.electing {
+		return nil
+	}
+	c.electing = true
+	c.answered = false
+	c.round++
+	round := c.round
+
+	var out []coMessage
+	for id := range c.n.livePeers() {
+		if id > c.n.ID {
+			out = append(out, coMessage{to: id, kind: coElection})
+		}
+	}
+	if len(out) == 0 {
+		return c.becomeLeader()
+	}
+	c.n.logf("Node %s starting an election among %d higher members", c.n.ID, len(out))
+	time.AfterFunc(2*c.n.Config.HeartbeatInterval, func() { c.electionTimeout(round) })
+	return out
+}
+
+// electionTimeout runs once the higher members had time to answer. If one
+// did, it waits for its COORDINATOR message, and starts over if that does
+// not come either.
+func (c *coordinator) electionTimeout(round uint64) {
+	c.mu.Lock()
+	var out []coMessage
+	if c.round == round && c.electing {
+		if c.answered {
+			time.AfterFunc(c.n.Config.FailureTimeout, func() { c.restartElection(round) })
+		} else {
+			out = c.becomeLeader()
+		}
+	}
+	c.mu.Unlock()
+	c.post(out)
+}
+
+func (c *coordinator) restartElection(round uint64) {
+	c.mu.Lock()
+	var out []coMessage
+	if c.round == round && c.electing {
+		c.n.logf("Node %s heard of no coordinator, starting over", c.n.ID)
+		c.electing = false
+		out = c.elect()
+	}
+	c.mu.Unlock()
+	c.post(out)
+}
+
+// becomeLeader makes this node the coordinator. Its queues start from its
+// own request only; it grants nothing until every live member has reported
+// its own. Must be called with mu held.
+func (c *coordinator) becomeLeader() []coMessage {
+	c.n.logf("Node %s is the coordinator", c.n.ID)
+	c.leader = c.n.ID
+	c.electing = false
+	c.round++
+	c.syncing = make(map[string]bool)
+	var out []coMessage
+	for id := range c.n.livePeers() {
+		c.syncing[id] = true
+		out = append(out, coMessage{to: id, kind: coCoordinator})
+	}
+	for _, s := range c.locks {
+		s.holder = nil
+		s.queue = nil
+		if s.request == 0 {
+			continue
+		}
+		own := coEntry{node: c.n.ID, id: s.request}
+		if s.granted {
+			s.holder = &own
+		} else {
+			s.queue = append(s.queue, own)
+		}
+	}
+	if !c.tending {
+		c.tending = true
+		time.AfterFunc(c.n.Config.HeartbeatInterval, c.tend)
+	}
+	return append(out, c.finishSync()...)
+}
+
+// follow accepts from as the coordinator and reports what we hold and
+// request to it. Must be called with mu held.
+func (c *coordinator) follow(from string) []coMessage {
+	if c.leader != from {
+		c.n.logf("Node %s follows coordinator %s", c.n.ID, from)
+	}
+	c.leader = from
+	c.electing = false
+	c.round++
+	c.syncing = nil
+	var out []coMessage
+	for name, s := range c.locks {
+		s.holder = nil
+		s.queue = nil
+		switch {
+		case s.request == 0:
+		case s.granted:
+			out = append(out, coMessage{to: from, kind: coHolding, lock: name, id: s.request})
+		default:
+			out = append(out, coMessage{to: from, kind: coRequest, lock: name, id: s.request})
+		}
+	}
+	return append(out, coMessage{to: from, kind: coSynced})
+}
+
+// finishSync starts serving once every member has reported. Must be called
+// with mu held.
+func (c *coordinator) finishSync() []coMessage {
+	if c.syncing == nil || len(c.syncing) > 0 {
+		return nil
+	}
+	c.syncing = nil
+	c.n.logf("Node %s serving as coordinator", c.n.ID)
+	var out []coMessage
+	for name, s := range c.locks {
+		out = append(out, c.grantNext(name, s)...)
+	}
+	return out
+}
+
+// tend runs every heartbeat while we are the coordinator. It stops waiting
+// for members that died before reporting and takes the requests of dead
+// members out of the queues, including one holding a lock.
+func (c *coordinator) tend() {
+	c.mu.Lock()
+	if c.leader != c.n.ID {
+		c.tending = false
+		c.mu.Unlock()
+		return
+	}
+	for id := range c.syncing {
+		if c.n.PeerState(id) == PeerDead {
+			c.n.logf("Node %s not waiting for dead member %s to report", c.n.ID, id)
+			delete(c.syncing, id)
+		}
+	}
+	out := c.finishSync()
+	dead := func(e coEntry) bool { return e.node != c.n.ID && c.n.PeerState(e.node) == PeerDead }
+	for name, s := range c.locks {
+		s.queue = slices.DeleteFunc(s.queue, dead)
+		if s.holder != nil && dead(*s.holder) {
+			c.n.logf("Node %s taking lock %s back from dead member %s", c.n.ID, name, s.holder.node)
+			s.holder = nil
+			out = append(out, c.grantNext(name, s)...)
+		}
+	}
+	c.mu.Unlock()
+	c.post(out)
+	time.AfterFunc(c.n.Config.HeartbeatInterval, c.tend)
+}
@@ -0,0 +1,65 @@
+package peer
+
+import (
+	"fmt"
+	pb "mutex/stc"
+)
+
+// FencingToken identifies one entry into a lock's critical section. It is the
+// holder's Lamport clock on entry together with the node ID of its request.
+// Every holder needs a reply that was sent after the previous holder left, or
+// a deferral or lease notice sent while it held, and each of those raises the
+// receiver's clock past the previous entry. So the tokens of successive
+// holders are strictly increasing, and a store that remembers the highest
+// token it has seen can reject writes from a holder that has since lost the
+// lock.
+//
+// That chain breaks when a holder is declared dead. The next holder then
+// enters without hearing from it, possibly with a lower clock than the token
+// of the dead holder, and if that one was only paused, the store keeps
+// accepting its writes and rejects the new holder's. Tokens are only ordered
+// across holders that were not excluded by the failure detector.
+type FencingToken struct {
+	Timestamp uint64
+	NodeID    string
+}
+
+// Less reports whether t was issued before o.
+func (t FencingToken) Less(o FencingToken) bool {
+	if t.Timestamp == o.Timestamp {
+		return t.NodeID < o.NodeID
+	}
+	return t.Timestamp < o.Timestamp
+}
+
+func (t FencingToken) IsZero() bool {
+	return t == FencingToken{}
+}
+
+func (t FencingToken) String() string {
+	return fmt.Sprintf("%d/%s", t.Timestamp, t.NodeID)
+}
+
+func (t FencingToken) proto() *pb.FencingToken {
+	if t.IsZero() {
+		return nil
+	}
+	return &pb.FencingToken{LamportTimestamp: t.Timestamp, NodeId: t.NodeID}
+}
+
+// Token returns the fencing token of the current hold of the lock by this
+// node. Pass it along with every write to the protected resource.
+func (l *Lock) Token() (FencingToken, error) {
+	n := l.node
+	n.ReqMu.Lock()
+	defer n.ReqMu.Unlock()
+
+	ls, ok := n.locks[l.name]
+	if ok && ls.expired {
+		return FencingToken{}, ErrLeaseExpired
+	}
+	if !ok || !ls.inCS {
+		return FencingToken{}, ErrNotHeld
+	}
+	return ls.token, nil
+}
@@ -0,0 +1,41 @@
+package peer
+
+import (
+	"fmt"
+	"time"
+)
+
+// Clocks a node can keep in LamportClock, for Config.Clock. Every node of a
+// cluster must use the same one.
+const (
+	ClockLamport = "lamport"
+	ClockHLC     = "hlc"
+)
+
+// hlcLogicalBits is the width of the logical counter at the bottom of a
+// hybrid logical clock value; the bits above it hold the wall-clock time in
+// milliseconds since the Unix epoch.
+const hlcLogicalBits = 16
+
+// A hybrid logical clock moves like a Lamport clock but never falls behind
+// the wall clock. It is packed into the same uint64, so timestamps still
+// compare with <, and isHigherPriority and fencing tokens keep their meaning,
+// while the upper bits say roughly when the event happened.
+
+// hlcNow is the smallest hybrid logical clock value of the current time.
+func hlcNow() uint64 {
+	return uint64(time.Now().UnixMilli()) << hlcLogicalBits
+}
+
+// HLCTime returns the wall-clock time of a hybrid logical clock value.
+func HLCTime(ts uint64) time.Time {
+	return time.UnixMilli(int64(ts >> hlcLogicalBits))
+}
+
+// stamp renders ts for the node's log lines.
+func (n *Node) stamp(ts uint64) string {
+	if n.Config.Clock == ClockHLC {
+		return fmt.Sprintf("HLC timestamp %s+%d", HLCTime(ts).Format("2006/01/02 15:04:05.000"), ts&(1<<hlcLogicalBits-1))
+	}
+	return fmt.Sprintf("Lamport timestamp %d", ts)
+}
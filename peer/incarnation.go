@@ -0,0 +1,125 @@
+package peer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Every run of a node has its own incarnation, Node.Incarnation, which every
+// message carries. The peer table remembers the latest incarnation heard
+// from each peer, so a node notices that a peer restarted on the first
+// message of its new run. It then drops what it kept about the old run,
+// through PeerRestartHandler, before that message is handled, and refuses
+// anything still arriving from the old run. Replies also name the
+// incarnation of the request they answer, so a reply meant for a request of
+// our own previous run is not credited to a request of this one that
+// happens to reuse its ID.
+
+// nextIncarnation returns the incarnation of a run that follows the run
+// last: the wall clock in nanoseconds, unless the clock has stepped back to
+// last or before it, which would make peers take the new run for an old one.
+func nextIncarnation(last uint64) uint64 {
+	return max(uint64(time.Now().UnixNano()), last+1)
+}
+
+// startIncarnation picks the incarnation of this run and records it before
+// any peer hears of it: in the write-ahead log if the node keeps one, and in
+// a file of its own in the user's cache directory otherwise. If that file
+// cannot be written the wall clock is all the node goes by.
+func (n *Node) startIncarnation() error {
+	if n.wal != nil {
+		n.Incarnation = nextIncarnation(n.wal.state.incarnation)
+		return n.persist(walRecord{Op: walIncarnation, Incarnation: n.Incarnation}, true)
+	}
+
+	var last uint64
+	dir, err := os.UserCacheDir()
+	path := filepath.Join(dir, "mutex", n.ID+".incarnation")
+	if err == nil {
+		if data, err := os.ReadFile(path); err == nil {
+			last, _ = strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+		}
+	}
+	n.Incarnation = nextIncarnation(last)
+	if err == nil {
+		err = writeIncarnation(path, n.Incarnation)
+	}
+	if err != nil {
+		n.logf("Node %s cannot record its incarnation: %v", n.ID, err)
+	}
+	return nil
+}
+
+// writeIncarnation replaces the file at path with incarnation, so that a
+// crash leaves either the old or the new value.
+func writeIncarnation(path string, incarnation uint64) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(f, incarnation)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// checkIncarnation notes that peerID sent a message from incarnation. It
+// fails for a message from a run of the peer older than one already heard
+// from. A newer run resets what the node and its algorithm keep about the
+// peer first. Unknown peers and incarnation 0 are let through.
+func (n *Node) checkIncarnation(peerID string, incarnation uint64) error {
+	if incarnation == 0 || peerID == n.ID {
+		return nil
+	}
+	// Held across the reset so that no message of the new run is handled
+	// before the old run is forgotten.
+	n.incarnationMu.Lock()
+	defer n.incarnationMu.Unlock()
+
+	n.PeerMu.RLock()
+	info, ok := n.peerInfo[peerID]
+	var known uint64
+	if ok {
+		known = info.incarnation
+	}
+	n.PeerMu.RUnlock()
+	if !ok || incarnation == known {
+		return nil
+	}
+	if incarnation < known {
+		return fmt.Errorf("message from incarnation %d of %s, which has restarted as %d", incarnation, peerID, known)
+	}
+
+	if known != 0 {
+		n.logf("Node %s sees peer %s restarted (incarnation %d, was %d)", n.ID, peerID, incarnation, known)
+		if h, ok := n.algorithm().(PeerRestartHandler); ok {
+			h.PeerRestarted(peerID)
+		}
+	}
+	n.PeerMu.Lock()
+	info.incarnation = incarnation
+	n.PeerMu.Unlock()
+	return nil
+}
+
+// fromThisRun reports whether a reply addressed to the request incarnation
+// was made is meant for this run of the node. Replies that do not say are
+// taken to be.
+func (n *Node) fromThisRun(incarnation uint64) bool {
+	return incarnation == 0 || incarnation == n.Incarnation
+}
@@ -0,0 +1,257 @@
+package peer
+
+import (
+	"context"
+	"fmt"
+	pb "mutex/stc"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Kinds of Lamport messages. Sequence carries the timestamp of the request a
+// REQUEST or RELEASE is about.
+const (
+	lqRequest = "REQUEST" // add my request to your queue
+	lqAck     = "ACK"     // your request is in my queue
+	lqRelease = "RELEASE" // take my request out of your queue
+)
+
+// lamport is Lamport's 1978 algorithm. Every node keeps a replica of the
+// queue of requests, ordered by Lamport timestamp and then node ID, which
+// REQUEST and RELEASE broadcasts keep up to date. A node enters once its own
+// request heads its queue and it has heard something later than that
+// request from every other member: messages from a member arrive in order,
+// so no earlier request of it can still be on its way. An entry costs
+// 3(N-1) messages. Requires exclusive mode, one permit and no lease.
+type lamport struct {
+	n      *Node
+	mu     sync.Mutex        // guards everything below
+	latest map[string]uint64 // highest Lamport timestamp received from each member
+	locks  map[string]*lqLock
+}
+
+// lqEntry is one request in the queue.
+type lqEntry struct {
+	node string
+	ts   uint64
+}
+
+func (e lqEntry) before(o lqEntry) bool {
+	if e.ts == o.ts {
+		return e.node < o.node
+	}
+	return e.ts < o.ts
+}
+
+// lqLock is the Lamport state of one lock.
+type lqLock struct {
+	queue   []lqEntry // every request we know of, earliest first
+	request *lqEntry  // our own request, nil if there is none
+	members []string  // peers that must have sent something later than request
+	inCS    bool
+	entered chan struct{} // closed once request may enter
+}
+
+func newLamport(n *Node) (MutexAlgorithm, error) {
+	return &lamport{n: n, latest: make(map[string]uint64), locks: make(map[string]*lqLock)}, nil
+}
+
+func (lq *lamport) Name() string {
+	return AlgorithmLamport
+}
+
+// lock returns the state of name, creating it on first use. Must be called
+// with mu held.
+func (lq *lamport) lock(name string) *lqLock {
+	s, ok := lq.locks[name]
+	if !ok {
+		s = &lqLock{}
+		lq.locks[name] = s
+	}
+	return s
+}
+
+func (lq *lamport) Request(ctx context.Context, req *Request) error {
+	if err := exclusiveOnly(req); err != nil {
+		return err
+	}
+	name := req.Lock
+	n := lq.n
+	peers := n.livePeers()
+
+	lq.mu.Lock()
+	s := lq.lock(name)
+	s.request = &lqEntry{node: n.ID, ts: req.Timestamp}
+	s.queue = insertEntry(s.queue, *s.request)
+	s.members = make([]string, 0, len(peers))
+	for id := range peers {
+		s.members = append(s.members, id)
+	}
+	entered := make(chan struct{})
+	s.entered = entered
+	lq.check(s)
+	lq.mu.Unlock()
+
+	for id := range peers {
+		n.Post(id, &pb.AlgorithmMessage{Kind: lqRequest, Lock: name, Sequence: req.Timestamp})
+	}
+
+	// A member that dies stops being waited for, which only shows up on the
+	// next check.
+	recheck := time.NewTicker(n.Config.HeartbeatInterval)
+	defer recheck.Stop()
+	for {
+		select {
+		case <-entered:
+			return nil
+		case <-recheck.C:
+			lq.mu.Lock()
+			lq.check(s)
+			lq.mu.Unlock()
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Release takes our request out of every queue, whether it was served or
+// abandoned.
+func (lq *lamport) Release(name string) {
+	lq.mu.Lock()
+	s := lq.lock(name)
+	req, members := s.request, s.members
+	if req != nil {
+		s.queue = slices.DeleteFunc(s.queue, func(e lqEntry) bool { return e == *req })
+	}
+	s.request = nil
+	s.members = nil
+	s.inCS = false
+	s.entered = nil
+	lq.mu.Unlock()
+
+	if req == nil {
+		return
+	}
+	for _, id := range members {
+		lq.n.Post(id, &pb.AlgorithmMessage{Kind: lqRelease, Lock: name, Sequence: req.ts})
+	}
+}
+
+func (lq *lamport) Handle(msg *pb.AlgorithmMessage) {
+	lq.mu.Lock()
+	lq.latest[msg.NodeId] = max(lq.latest[msg.NodeId], msg.LamportTimestamp)
+	s := lq.lock(msg.Lock)
+	entry := lqEntry{node: msg.NodeId, ts: msg.Sequence}
+	ack := false
+	var ours *lqEntry
+	switch msg.Kind {
+	case lqRequest:
+		s.queue = insertEntry(s.queue, entry)
+		ack = true
+		// A member we did not tell about our request (it joined or came
+		// back since) must hear of it before our ACK could let it in.
+		if s.request != nil && !slices.Contains(s.members, msg.NodeId) {
+			s.members = append(s.members, msg.NodeId)
+			ours = s.request
+		}
+	case lqAck:
+	case lqRelease:
+		s.queue = slices.DeleteFunc(s.queue, func(e lqEntry) bool { return e == entry })
+	default:
+		lq.n.logf("Node %s ignoring unknown %s message %s", lq.n.ID, lq.Name(), msg.Kind)
+	}
+	lq.check(s)
+	lq.mu.Unlock()
+
+	if ours != nil {
+		lq.n.Post(msg.NodeId, &pb.AlgorithmMessage{Kind: lqRequest, Lock: msg.Lock, Sequence: ours.ts})
+	}
+	if ack {
+		lq.n.Post(msg.NodeId, &pb.AlgorithmMessage{Kind: lqAck, Lock: msg.Lock, Sequence: msg.Sequence})
+	}
+}
+
+// PeerRestarted drops the requests of peerID's previous run from the queues
+// and tells the new run about ours, as it forgot them.
+func (lq *lamport) PeerRestarted(peerID string) {
+	lq.mu.Lock()
+	delete(lq.latest, peerID)
+	ours := make(map[string]uint64)
+	for name, s := range lq.locks {
+		s.queue = slices.DeleteFunc(s.queue, func(e lqEntry) bool { return e.node == peerID })
+		if s.request != nil {
+			if !slices.Contains(s.members, peerID) {
+				s.members = append(s.members, peerID)
+			}
+			ours[name] = s.request.ts
+		}
+		lq.check(s)
+	}
+	lq.mu.Unlock()
+
+	for name, ts := range ours {
+		lq.n.Post(peerID, &pb.AlgorithmMessage{Kind: lqRequest, Lock: name, Sequence: ts})
+	}
+}
+
+// check lets our request in once it heads the queue and every live member
+// has sent us something later than it. Requests of members that died are
+// dropped from the queue. Must be called with mu held.
+func (lq *lamport) check(s *lqLock) {
+	if s.request == nil || s.inCS {
+		return
+	}
+	s.queue = slices.DeleteFunc(s.queue, func(e lqEntry) bool {
+		return e.node != lq.n.ID && lq.n.PeerState(e.node) == PeerDead
+	})
+	if len(s.queue) == 0 || s.queue[0] != *s.request {
+		return
+	}
+	for _, id := range s.members {
+		if lq.latest[id] <= s.request.ts && lq.n.PeerState(id) != PeerDead {
+			return
+		}
+	}
+	s.inCS = true
+	close(s.entered)
+}
+
+func (lq *lamport) State(name string) string {
+	lq.mu.Lock()
+	defer lq.mu.Unlock()
+
+	s, ok := lq.locks[name]
+	if !ok || s.request == nil || s.inCS {
+		return ""
+	}
+	heard := 0
+	for _, id := range s.members {
+		if lq.latest[id] > s.request.ts {
+			heard++
+		}
+	}
+	return fmt.Sprintf("position %d of %d in the queue, heard from %d of %d members", slices.Index(s.queue, *s.request)+1, len(s.queue), heard, len(s.members))
+}
+
+// Leave has nothing to hand over: our requests were released already.
+func (lq *lamport) Leave() {}
+
+// insertEntry adds e to the sorted queue unless it is there already, as a
+// retried REQUEST would be.
+func insertEntry(queue []lqEntry, e lqEntry) []lqEntry {
+	i, found := slices.BinarySearchFunc(queue, e, func(a, b lqEntry) int {
+		switch {
+		case a == b:
+			return 0
+		case a.before(b):
+			return -1
+		default:
+			return 1
+		}
+	})
+	if found {
+		return queue
+	}
+	return slices.Insert(queue, i, e)
+}
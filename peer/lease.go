@@ -0,0 +1,190 @@
+package peer
+
+import (
+	"context"
+	pb "mutex/stc"
+	"time"
+)
+
+// leaseCheckInterval is how often a waiting requester looks for holders whose
+// lease has run out.
+const leaseCheckInterval = 100 * time.Millisecond
+
+// A lease bounds how long a holder may keep peers waiting. The holder starts
+// its lease clock before telling anyone about it and expires itself at
+// exactly ttl, while a requester only gives up on the holder after the
+// remaining time it was told plus Config.LeaseGrace, measured from when the
+// news arrived. The holder therefore always loses the lock before anybody
+// else treats it as released, as long as clocks drift by less than the grace.
+
+// --- Server functions ---
+func (n *Node) RenewLease(ctx context.Context, req *pb.LeaseRenewal) (*pb.LeaseRenewalResponse, error) {
+	if _, err := n.permissions(); err != nil {
+		return nil, err
+	}
+	if err := n.checkIncarnation(req.NodeId, req.Incarnation); err != nil {
+		return nil, err
+	}
+	// Moves our clock past the holder's fencing token in case we end up
+	// entering without its reply.
+	n.UpdateLamportClock(req.LamportTimestamp)
+	n.mergeVector(req.VectorClock)
+
+	n.ReqMu.Lock()
+	defer n.ReqMu.Unlock()
+
+	ls, ok := n.locks[req.Lock]
+	if ok && ls.round != nil && ls.round.requestID == req.RequestId && n.fromThisRun(req.RequestIncarnation) {
+		n.extendLeaseDeadline(ls.round, req.NodeId, req.RemainingMs)
+	}
+	return &pb.LeaseRenewalResponse{}, nil
+}
+
+// --- client functions ---
+
+// Renew restarts the lease of the lock held by this node and tells every
+// waiting peer. It returns ErrLeaseExpired if the lease already ran out.
+func (l *Lock) Renew() error {
+	n := l.node
+	n.ReqMu.Lock()
+	ls, ok := n.locks[l.name]
+	if ok && ls.expired {
+		n.ReqMu.Unlock()
+		return ErrLeaseExpired
+	}
+	if !ok || !ls.inCS {
+		n.ReqMu.Unlock()
+		return ErrNotHeld
+	}
+	if ls.lease == 0 {
+		n.ReqMu.Unlock()
+		return nil
+	}
+	ttl := ls.lease
+	ls.leaseExpiry = time.Now().Add(ttl)
+	ls.leaseTimer.Reset(ttl)
+	deferred := ls.deferredRequests()
+	n.ReqMu.Unlock()
+
+	n.announceLease(l.name, deferred, ttl)
+	return nil
+}
+
+// Lost returns a channel that is closed if the lease of the current hold runs
+// out. It returns nil, which blocks forever, when the lock is not held with a
+// lease.
+func (l *Lock) Lost() <-chan struct{} {
+	n := l.node
+	n.ReqMu.Lock()
+	defer n.ReqMu.Unlock()
+
+	if ls, ok := n.locks[l.name]; ok && ls.lost != nil {
+		return ls.lost
+	}
+	return nil
+}
+
+// startLease starts the lease clock of a fresh hold. Must be called with
+// ReqMu held.
+func (n *Node) startLease(ls *lockState, ttl time.Duration) {
+	requestID := ls.current.RequestId
+	ls.lease = ttl
+	ls.leaseExpiry = time.Now().Add(ttl)
+	ls.lost = make(chan struct{})
+	ls.leaseTimer = time.AfterFunc(ttl, func() { n.expireLease(ls, requestID) })
+}
+
+// stopLease forgets the lease of ls. Must be called with ReqMu held.
+func (ls *lockState) stopLease() {
+	if ls.leaseTimer != nil {
+		ls.leaseTimer.Stop()
+	}
+	ls.lease = 0
+	ls.leaseTimer = nil
+	ls.lost = nil
+}
+
+// leaseRemainingMs is what a deferred requester is told about our lease.
+// Must be called with ReqMu held.
+func (ls *lockState) leaseRemainingMs() uint64 {
+	if !ls.inCS || ls.lease == 0 {
+		return 0
+	}
+	return uint64(max(time.Until(ls.leaseExpiry).Milliseconds(), 1))
+}
+
+// expireLease releases a hold whose lease ran out. The local gate stays taken
+// until the late holder calls Release, which then reports ErrLeaseExpired.
+func (n *Node) expireLease(ls *lockState, requestID uint64) {
+	n.ReqMu.Lock()
+	if !ls.inCS || ls.current == nil || ls.current.RequestId != requestID || time.Now().Before(ls.leaseExpiry) {
+		// Released or renewed in the meantime
+		n.ReqMu.Unlock()
+		return
+	}
+	lost := ls.lost
+	ls.reset()
+	deferred := ls.takeDeferred()
+	ls.expired = true
+	ls.lost = lost // keep reporting the loss until the late holder calls Release
+	n.ReqMu.Unlock()
+
+	close(lost)
+	n.persistLater(walRecord{Op: walLeave, Lock: ls.name})
+	releaseTimestamp := n.GetLamportClock()
+	n.logf("Node %s lost lock %s: lease expired", n.ID, ls.name)
+	n.sendDeferredResponses(deferred, releaseTimestamp)
+}
+
+// announceLease tells every deferred requester how long our lease has left.
+func (n *Node) announceLease(lock string, deferred []*pb.AccessRequest, ttl time.Duration) {
+	for _, req := range deferred {
+		n.PeerMu.RLock()
+		client := n.Peers[req.NodeId]
+		n.PeerMu.RUnlock()
+		if client == nil {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), ttl)
+		_, err := client.RenewLease(ctx, &pb.LeaseRenewal{
+			NodeId:             n.ID,
+			Lock:               lock,
+			RequestId:          req.RequestId,
+			RemainingMs:        uint64(ttl.Milliseconds()),
+			LamportTimestamp:   n.GetLamportClock(),
+			VectorClock:        n.tickVector(),
+			Incarnation:        n.Incarnation,
+			RequestIncarnation: req.Incarnation,
+		})
+		cancel()
+		if err != nil {
+			n.logf("Error announcing lease on lock %s to %s: %v", lock, req.NodeId, err)
+		}
+	}
+}
+
+// extendLeaseDeadline records how long we may have to wait for peerID, which
+// is holding the lock under a lease. Must be called with ReqMu held.
+func (n *Node) extendLeaseDeadline(r *replyRound, peerID string, remainingMs uint64) {
+	if !r.pending[peerID] || remainingMs == 0 {
+		return
+	}
+	r.leaseDeadlines[peerID] = time.Now().Add(time.Duration(remainingMs)*time.Millisecond + n.Config.LeaseGrace)
+}
+
+// expireLeaseDeadlines stops waiting for holders whose lease has certainly run
+// out by now. Must be called with ReqMu held.
+func (n *Node) expireLeaseDeadlines(ls *lockState) {
+	r := ls.round
+	if r == nil {
+		return
+	}
+	now := time.Now()
+	for peerID, deadline := range r.leaseDeadlines {
+		if now.After(deadline) && r.pending[peerID] {
+			n.logf("Node %s treating %s as released from lock %s: lease expired", n.ID, peerID, ls.name)
+			r.drop(peerID)
+		}
+	}
+}
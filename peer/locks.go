@@ -0,0 +1,403 @@
+package peer
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	pb "mutex/stc"
+	"time"
+)
+
+// DefaultLock is the lock used by Node.Acquire, Node.Release and Node.WithLock.
+const DefaultLock = "default"
+
+// lockState is the Ricart-Agrawala state of one named lock on this node. It
+// is created when a local caller first asks for the lock and dropped again as
+// soon as nobody uses it and no reply is owed, so idle locks cost nothing.
+// All fields are guarded by Node.ReqMu.
+type lockState struct {
+	name     string
+	wantCS   bool       // state == WANTED
+	inCS     bool       // state == HELD; state == RELEASED if neither is true
+	deferred *list.List // *pb.AccessRequest we still owe a reply
+	current  *pb.AccessRequest
+	round    *replyRound   // replies collected for current
+	gate     chan struct{} // serializes local callers of the lock
+	users    int           // local callers holding or queued on gate
+
+	authorized map[string]bool   // peers whose permission we kept after they replied (Roucairol-Carvalho)
+	withdrawn  map[string]uint64 // highest request ID each peer withdrew
+
+	token FencingToken // of the current hold
+
+	lease       time.Duration // lease of the current holder, 0 if none
+	leaseExpiry time.Time
+	leaseTimer  *time.Timer
+	lost        chan struct{} // closed when the lease runs out while held
+	expired     bool          // the lease ran out and the holder has not called Release yet
+}
+
+func (ls *lockState) state() string {
+	switch {
+	case ls.inCS:
+		return "HELD"
+	case ls.wantCS:
+		return "WANTED"
+	default:
+		return "RELEASED"
+	}
+}
+
+func (ls *lockState) idle() bool {
+	return ls.users == 0 && !ls.wantCS && !ls.inCS && ls.deferred.Len() == 0 && len(ls.authorized) == 0
+}
+
+// useLock returns the state of name, creating it if needed, and registers the
+// caller as a user so it is not collected underneath it.
+func (n *Node) useLock(name string) *lockState {
+	n.ReqMu.Lock()
+	defer n.ReqMu.Unlock()
+
+	ls, ok := n.locks[name]
+	if !ok {
+		ls = newLockState(name)
+		n.locks[name] = ls
+	}
+	ls.users++
+	return ls
+}
+
+func newLockState(name string) *lockState {
+	return &lockState{
+		name:       name,
+		deferred:   list.New(),
+		authorized: make(map[string]bool),
+		withdrawn:  make(map[string]uint64),
+		gate:       make(chan struct{}, 1),
+	}
+}
+
+// doneWithLock undoes useLock.
+func (n *Node) doneWithLock(ls *lockState) {
+	n.ReqMu.Lock()
+	defer n.ReqMu.Unlock()
+	ls.users--
+	n.collectLock(ls)
+}
+
+// collectLock drops ls if it is idle. Must be called with ReqMu held.
+func (n *Node) collectLock(ls *lockState) {
+	if ls.idle() && n.locks[ls.name] == ls {
+		delete(n.locks, ls.name)
+	}
+}
+
+// busyLocks counts the locks that are wanted or held on this node.
+func (n *Node) busyLocks() int {
+	n.ReqMu.Lock()
+	defer n.ReqMu.Unlock()
+
+	busy := 0
+	for _, ls := range n.locks {
+		if ls.wantCS || ls.inCS {
+			busy++
+		}
+	}
+	return busy
+}
+
+// Lock is a handle on one named lock of the cluster. Handles are cheap and
+// any number of them may refer to the same name; callers on this node are
+// served one at a time per name.
+type Lock struct {
+	node    *Node
+	name    string
+	permits int           // k for a k-mutual exclusion lock, 1 for a plain mutex
+	lease   time.Duration // how long a hold lasts without Renew, 0 for forever
+}
+
+// Lock returns a handle on the lock called name.
+func (n *Node) Lock(name string) *Lock {
+	return &Lock{node: n, name: name, permits: 1}
+}
+
+// Semaphore returns a handle on the lock called name that admits up to k
+// holders cluster-wide (k-mutual exclusion). Every node must use the same k
+// for a given name.
+func (n *Node) Semaphore(name string, k int) *Lock {
+	if k < 1 {
+		k = 1
+	}
+	return &Lock{node: n, name: name, permits: k}
+}
+
+// Leased returns a copy of the handle whose acquisitions only last for ttl
+// unless renewed with Renew. When a lease runs out the lock is released on the
+// holder's behalf; Lost is closed and Release and Renew return
+// ErrLeaseExpired. A ttl of 0 disables the lease.
+func (l *Lock) Leased(ttl time.Duration) *Lock {
+	leased := *l
+	leased.lease = ttl
+	return &leased
+}
+
+func (l *Lock) Name() string {
+	return l.name
+}
+
+// Acquire blocks until this node holds the lock exclusively or ctx is done.
+// Calling Acquire again from the holder without a Release deadlocks just like
+// sync.Mutex. On cancellation the pending request is withdrawn from every
+// peer and any request deferred in the meantime is answered.
+func (l *Lock) Acquire(ctx context.Context) error {
+	return l.acquire(ctx, pb.LockMode_EXCLUSIVE, false)
+}
+
+// AcquireShared is like Acquire but takes the lock in shared mode, so holders
+// on other nodes that also took it shared may be in the critical section at
+// the same time. Shared and exclusive callers on this node still take turns.
+func (l *Lock) AcquireShared(ctx context.Context) error {
+	return l.acquire(ctx, pb.LockMode_SHARED, false)
+}
+
+// TryAcquire takes the lock exclusively only if that needs no waiting: another
+// local caller, a peer deferring us or a peer that does not answer within
+// Config.HeartbeatInterval makes it withdraw the request and return
+// ErrWouldBlock.
+func (l *Lock) TryAcquire() error {
+	return l.tryAcquire(pb.LockMode_EXCLUSIVE)
+}
+
+// TryAcquireShared is TryAcquire in shared mode.
+func (l *Lock) TryAcquireShared() error {
+	return l.tryAcquire(pb.LockMode_SHARED)
+}
+
+func (l *Lock) tryAcquire(mode pb.LockMode) error {
+	ctx, cancel := context.WithTimeout(context.Background(), l.node.Config.HeartbeatInterval)
+	defer cancel()
+
+	err := l.acquire(ctx, mode, true)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ErrWouldBlock
+	}
+	return err
+}
+
+// AcquireTimeout is Acquire that gives up, and withdraws the request, after d.
+func (l *Lock) AcquireTimeout(d time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+	return l.acquire(ctx, pb.LockMode_EXCLUSIVE, false)
+}
+
+// acquire asks the node's algorithm for the lock and marks it held once the
+// algorithm lets us in. With try set it never queues: it fails as soon as
+// waiting would be needed.
+func (l *Lock) acquire(ctx context.Context, mode pb.LockMode, try bool) error {
+	n := l.node
+	if mode == pb.LockMode_SHARED && l.permits > 1 {
+		return ErrSharedSemaphore
+	}
+
+	algo := n.algorithm()
+	if algo == nil || !n.isReady() {
+		return ErrNotReady
+	}
+
+	ls := n.useLock(l.name)
+
+	if try {
+		select {
+		case ls.gate <- struct{}{}:
+		default:
+			n.doneWithLock(ls)
+			return ErrWouldBlock
+		}
+	} else {
+		select {
+		case ls.gate <- struct{}{}:
+		case <-ctx.Done():
+			n.doneWithLock(ls)
+			return ctx.Err()
+		}
+	}
+
+	n.ReqMu.Lock()
+	if n.left {
+		n.ReqMu.Unlock()
+		<-ls.gate
+		n.doneWithLock(ls)
+		return ErrLeft
+	}
+	ls.wantCS = true
+	timestamp := n.GetLamportClock()
+	n.nextRequestID++
+	ls.current = &pb.AccessRequest{
+		NodeId:           n.ID,
+		LamportTimestamp: timestamp,
+		RequestId:        n.nextRequestID,
+		Lock:             l.name,
+		Mode:             mode,
+		Permits:          uint32(l.permits),
+		Incarnation:      n.Incarnation,
+	}
+	request := ls.current
+	n.ReqMu.Unlock()
+
+	n.logf("Node %s requesting lock %s in %s mode with %s (request %d)", n.ID, l.name, mode, n.stamp(timestamp), request.RequestId)
+	err := n.persist(walRecord{
+		Op:        walRequest,
+		Lock:      l.name,
+		RequestID: request.RequestId,
+		Timestamp: timestamp,
+		Mode:      mode.String(),
+		Permits:   request.Permits,
+	}, true)
+	if err == nil {
+		err = algo.Request(ctx, &Request{
+			Lock:      l.name,
+			ID:        request.RequestId,
+			Timestamp: timestamp,
+			Mode:      mode,
+			Permits:   l.permits,
+			Lease:     l.lease,
+			Try:       try,
+		})
+	}
+	if err == nil {
+		err = l.enter(ls, request)
+	}
+	if err != nil {
+		n.logf("Node %s giving up request %d for lock %s: %v", n.ID, request.RequestId, l.name, err)
+		n.leaveCriticalSection(ls)
+		return err
+	}
+	return nil
+}
+
+// enter marks ls as held once request has been granted, issuing the fencing
+// token and starting the lease. It fails if the token cannot be written to
+// the write-ahead log, as a restarted node might then issue it again.
+func (l *Lock) enter(ls *lockState, request *pb.AccessRequest) error {
+	n := l.node
+	token := FencingToken{Timestamp: n.GetLamportClock(), NodeID: request.NodeId}
+	if err := n.persist(walRecord{Op: walEnter, Lock: l.name, RequestID: request.RequestId, Timestamp: token.Timestamp}, true); err != nil {
+		return err
+	}
+	n.ReqMu.Lock()
+	ls.inCS = true
+	ls.expired = false
+	ls.token = token
+	n.tickVector()
+	var deferred []*pb.AccessRequest
+	if l.lease > 0 {
+		n.startLease(ls, l.lease)
+		deferred = ls.deferredRequests()
+	}
+	n.ReqMu.Unlock()
+
+	n.logf("Node %s entering critical section for lock %s in %s mode with %s (fencing token %s)", n.ID, l.name, request.Mode, n.stamp(token.Timestamp), token)
+	if l.lease > 0 {
+		go n.announceLease(l.name, deferred, l.lease)
+	}
+	return nil
+}
+
+// Release leaves the critical section and answers every deferred request.
+func (l *Lock) Release() error {
+	n := l.node
+	n.ReqMu.Lock()
+	ls, ok := n.locks[l.name]
+	if ok && ls.expired {
+		// Everything but the local gate was already released when the lease
+		// ran out; hand that back and tell the late holder.
+		ls.expired = false
+		ls.lost = nil
+		n.ReqMu.Unlock()
+		<-ls.gate
+		n.doneWithLock(ls)
+		return ErrLeaseExpired
+	}
+	if !ok || !ls.inCS {
+		n.ReqMu.Unlock()
+		return ErrNotHeld
+	}
+	ls.inCS = false
+	n.ReqMu.Unlock()
+
+	n.leaveCriticalSection(ls)
+	return nil
+}
+
+// WithLock runs fn inside the critical section and releases it afterwards,
+// whatever fn returns.
+func (l *Lock) WithLock(ctx context.Context, fn func() error) error {
+	return l.with(ctx, pb.LockMode_EXCLUSIVE, fn)
+}
+
+// WithSharedLock is WithLock for shared holders.
+func (l *Lock) WithSharedLock(ctx context.Context, fn func() error) error {
+	return l.with(ctx, pb.LockMode_SHARED, fn)
+}
+
+func (l *Lock) with(ctx context.Context, mode pb.LockMode, fn func() error) error {
+	if err := l.acquire(ctx, mode, false); err != nil {
+		return err
+	}
+
+	err := fn()
+	if releaseErr := l.Release(); err == nil {
+		err = releaseErr
+	}
+	return err
+}
+
+// leaveCriticalSection resets the request state of ls, tells the algorithm
+// and lets the next local caller in. It is used both on Release and when a
+// pending request is abandoned.
+func (n *Node) leaveCriticalSection(ls *lockState) {
+	n.ReqMu.Lock()
+	ls.reset()
+	n.ReqMu.Unlock()
+	n.tickVector()
+	n.persistLater(walRecord{Op: walLeave, Lock: ls.name})
+
+	n.logf("Node %s leaving critical section for lock %s with %s", n.ID, ls.name, n.stamp(n.GetLamportClock()))
+	n.algo.Release(ls.name)
+
+	<-ls.gate
+	n.doneWithLock(ls)
+}
+
+// reset returns ls to RELEASED. Must be called with ReqMu held.
+func (ls *lockState) reset() {
+	ls.inCS = false
+	ls.wantCS = false
+	ls.current = nil
+	ls.round = nil
+	ls.token = FencingToken{}
+	ls.stopLease()
+}
+
+// takeDeferred hands back the replies ls owes. Sending a reply gives the
+// permission away, so none of those peers stays authorized. Must be called
+// with ReqMu held.
+func (ls *lockState) takeDeferred() *list.List {
+	deferred := ls.deferred
+	for e := deferred.Front(); e != nil; e = e.Next() {
+		delete(ls.authorized, e.Value.(*pb.AccessRequest).NodeId)
+	}
+	ls.deferred = list.New()
+	return deferred
+}
+
+// deferredRequests copies the requests ls is deferring. Must be called with
+// ReqMu held.
+func (ls *lockState) deferredRequests() []*pb.AccessRequest {
+	reqs := make([]*pb.AccessRequest, 0, ls.deferred.Len())
+	for e := ls.deferred.Front(); e != nil; e = e.Next() {
+		reqs = append(reqs, e.Value.(*pb.AccessRequest))
+	}
+	return reqs
+}
@@ -0,0 +1,195 @@
+package peer
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	pb "mutex/stc"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// LockServer serves LockService for a Node, so that processes which are not
+// members of the cluster can take its locks. Each hold is a session owned by
+// the Acquire stream that created it and ends with that stream.
+type LockServer struct {
+	node     *Node
+	mu       sync.Mutex // guards sessions
+	sessions map[string]*session
+	pb.UnimplementedLockServiceServer
+}
+
+// session is one client hold of a lock.
+type session struct {
+	lock    *Lock
+	release chan chan error // Release hands the Acquire stream a channel for the result
+	done    chan struct{}   // closed once the hold is over
+}
+
+func NewLockServer(n *Node) *LockServer {
+	return &LockServer{
+		node:     n,
+		sessions: make(map[string]*session),
+	}
+}
+
+// --- Server functions ---
+func (s *LockServer) Acquire(req *pb.LockRequest, stream pb.LockService_AcquireServer) error {
+	n := s.node
+	ctx := stream.Context()
+	name := req.Lock
+	if name == "" {
+		name = DefaultLock
+	}
+	lock := n.Semaphore(name, int(req.Permits)).Leased(time.Duration(req.LeaseMs) * time.Millisecond)
+
+	n.logf("Node %s acquiring lock %s in %s mode for client %q", n.ID, name, req.Mode, req.Client)
+	var err error
+	if req.Try {
+		err = lock.tryAcquire(req.Mode)
+	} else {
+		acquireCtx := ctx
+		if req.TimeoutMs > 0 {
+			var cancel context.CancelFunc
+			acquireCtx, cancel = context.WithTimeout(ctx, time.Duration(req.TimeoutMs)*time.Millisecond)
+			defer cancel()
+		}
+		err = lock.acquire(acquireCtx, req.Mode, false)
+	}
+	if err != nil {
+		n.logf("Node %s failed to acquire lock %s for client %q: %v", n.ID, name, req.Client, err)
+		return lockServiceError(err)
+	}
+
+	id, sess := s.open(lock)
+	defer s.close(id)
+
+	token, err := lock.Token()
+	if err == nil {
+		err = stream.Send(&pb.LockEvent{
+			Granted:      true,
+			SessionId:    id,
+			FencingToken: token.proto(),
+			VectorClock:  n.VectorClock(),
+		})
+	}
+	if err != nil {
+		n.logf("Node %s could not tell client %q it holds lock %s: %v", n.ID, req.Client, name, err)
+		lock.Release()
+		return err
+	}
+
+	select {
+	case reply := <-sess.release:
+		reply <- lock.Release()
+		return nil
+	case <-ctx.Done():
+		n.logf("Node %s releasing lock %s: client %q went away", n.ID, name, req.Client)
+		lock.Release()
+		return ctx.Err()
+	case <-lock.Lost():
+		n.logf("Node %s lost lock %s held for client %q: lease expired", n.ID, name, req.Client)
+		lock.Release()
+		return stream.Send(&pb.LockEvent{SessionId: id, Lost: true, VectorClock: n.VectorClock()})
+	}
+}
+
+func (s *LockServer) Release(ctx context.Context, req *pb.SessionRequest) (*pb.SessionResponse, error) {
+	sess, err := s.session(req.SessionId)
+	if err != nil {
+		return nil, err
+	}
+
+	reply := make(chan error, 1)
+	select {
+	case sess.release <- reply:
+	case <-sess.done:
+		return nil, status.Errorf(codes.NotFound, "session %s has ended", req.SessionId)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if err := <-reply; err != nil {
+		return nil, lockServiceError(err)
+	}
+	return &pb.SessionResponse{}, nil
+}
+
+func (s *LockServer) Renew(ctx context.Context, req *pb.SessionRequest) (*pb.SessionResponse, error) {
+	sess, err := s.session(req.SessionId)
+	if err != nil {
+		return nil, err
+	}
+	if err := sess.lock.Renew(); err != nil {
+		return nil, lockServiceError(err)
+	}
+	return &pb.SessionResponse{}, nil
+}
+
+func (s *LockServer) Status(ctx context.Context, req *pb.StatusRequest) (*pb.StatusResponse, error) {
+	return s.node.Status(ctx, req)
+}
+
+// --- util functions ---
+
+func (s *LockServer) open(lock *Lock) (string, *session) {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	id := hex.EncodeToString(buf)
+	sess := &session{
+		lock:    lock,
+		release: make(chan chan error),
+		done:    make(chan struct{}),
+	}
+
+	s.mu.Lock()
+	s.sessions[id] = sess
+	s.mu.Unlock()
+	return id, sess
+}
+
+func (s *LockServer) close(id string) {
+	s.mu.Lock()
+	sess := s.sessions[id]
+	delete(s.sessions, id)
+	s.mu.Unlock()
+	close(sess.done)
+}
+
+func (s *LockServer) session(id string) (*session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.sessions[id]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "unknown session %s", id)
+	}
+	return sess, nil
+}
+
+// lockServiceError maps the errors of Lock to gRPC status codes so that
+// clients can tell a busy lock from a failure.
+func lockServiceError(err error) error {
+	code := codes.Internal
+	switch {
+	case errors.Is(err, ErrWouldBlock):
+		code = codes.ResourceExhausted
+	case errors.Is(err, ErrLeaseExpired):
+		code = codes.Aborted
+	case errors.Is(err, ErrNotHeld):
+		code = codes.FailedPrecondition
+	case errors.Is(err, ErrLeft), errors.Is(err, ErrNotReady):
+		code = codes.Unavailable
+	case errors.Is(err, ErrSharedSemaphore):
+		code = codes.InvalidArgument
+	case errors.Is(err, ErrUnsupported):
+		code = codes.Unimplemented
+	case errors.Is(err, context.DeadlineExceeded):
+		code = codes.DeadlineExceeded
+	case errors.Is(err, context.Canceled):
+		code = codes.Canceled
+	}
+	return status.Error(code, err.Error())
+}
@@ -0,0 +1,417 @@
+package peer
+
+import (
+	"context"
+	"fmt"
+	"math"
+	pb "mutex/stc"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Kinds of Maekawa messages. Sequence always carries the Lamport timestamp of
+// the request a message is about, which together with the requester's node
+// ID identifies the request and orders it against others.
+const (
+	mkRequest    = "REQUEST"
+	mkLocked     = "LOCKED"     // voter to requester: you have my vote
+	mkFailed     = "FAILED"     // voter to requester: a request before yours holds or wants my vote
+	mkInquire    = "INQUIRE"    // voter to requester: may I have my vote back for an earlier request?
+	mkRelinquish = "RELINQUISH" // requester to voter: take your vote back
+	mkRelease    = "RELEASE"    // requester to voter: done, or no longer interested
+)
+
+// maekawa is Maekawa's quorum algorithm. A node enters once every member of
+// its voting set has voted for it, and every voter votes for one request at a
+// time. Any two voting sets share a member, so two requests can never both
+// collect all their votes. INQUIRE, FAILED and RELINQUISH let a voter take a
+// vote back from a request that cannot win yet, which breaks the deadlocks of
+// the original algorithm. An entry costs about 3*sqrt(N) messages.
+// Requires exclusive mode, one permit and no lease.
+type maekawa struct {
+	n     *Node
+	mu    sync.Mutex // guards locks
+	locks map[string]*mkLock
+}
+
+// mkReq identifies one request and orders it by Lamport timestamp, then
+// node ID.
+type mkReq struct {
+	node string
+	ts   uint64
+}
+
+func (r mkReq) before(o mkReq) bool {
+	if r.ts == o.ts {
+		return r.node < o.node
+	}
+	return r.ts < o.ts
+}
+
+// mkQueued is a request waiting for our vote.
+type mkQueued struct {
+	mkReq
+	failed bool // FAILED was sent for it
+}
+
+// mkLock is the Maekawa state of one lock, both as a voter and as a
+// requester.
+type mkLock struct {
+	voted    *mkReq     // request our vote is given to
+	queue    []mkQueued // requests waiting for our vote, earliest first
+	inquired bool       // INQUIRE was sent for voted
+
+	request   *mkReq          // our own request, nil if there is none
+	quorum    []string        // voting set of request
+	votes     map[string]bool // voters that have voted for request
+	inquiries map[string]bool // voters that asked for their vote back
+	failed    bool            // some voter sent FAILED for request
+	inCS      bool
+	entered   chan struct{} // closed once every voter has voted
+}
+
+// mkMessage is a message to post once mu is released.
+type mkMessage struct {
+	to   string
+	kind string
+	ts   uint64
+}
+
+func newMaekawa(n *Node) (MutexAlgorithm, error) {
+	return &maekawa{n: n, locks: make(map[string]*mkLock)}, nil
+}
+
+func (mk *maekawa) Name() string {
+	return AlgorithmMaekawa
+}
+
+// lock returns the state of name, creating it on first use. Must be called
+// with mu held.
+func (mk *maekawa) lock(name string) *mkLock {
+	s, ok := mk.locks[name]
+	if !ok {
+		s = &mkLock{}
+		mk.locks[name] = s
+	}
+	return s
+}
+
+func (mk *maekawa) Request(ctx context.Context, req *Request) error {
+	if err := exclusiveOnly(req); err != nil {
+		return err
+	}
+	name := req.Lock
+	n := mk.n
+	// Every node computes the sets from the members it was started with, so
+	// the sets of any two nodes intersect.
+	quorum := votingSet(n.initialMembers, n.ID)
+
+	mk.mu.Lock()
+	s := mk.lock(name)
+	s.request = &mkReq{node: n.ID, ts: n.GetLamportClock()}
+	s.quorum = quorum
+	s.votes = make(map[string]bool)
+	s.inquiries = make(map[string]bool)
+	s.failed = false
+	entered := make(chan struct{})
+	s.entered = entered
+	ts := s.request.ts
+	mk.mu.Unlock()
+
+	n.logf("Node %s asking voting set %v for lock %s (request %d)", n.ID, quorum, name, ts)
+	for _, id := range quorum {
+		n.Post(id, &pb.AlgorithmMessage{Kind: mkRequest, Lock: name, Sequence: ts})
+	}
+
+	select {
+	case <-entered:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Release returns every vote, and takes the request out of the queue of every
+// voter that has not voted for it yet.
+func (mk *maekawa) Release(name string) {
+	mk.mu.Lock()
+	s := mk.lock(name)
+	req, quorum := s.request, s.quorum
+	s.request = nil
+	s.quorum = nil
+	s.votes = nil
+	s.inquiries = nil
+	s.inCS = false
+	s.entered = nil
+	mk.mu.Unlock()
+
+	if req == nil {
+		return
+	}
+	for _, id := range quorum {
+		mk.n.Post(id, &pb.AlgorithmMessage{Kind: mkRelease, Lock: name, Sequence: req.ts})
+	}
+}
+
+func (mk *maekawa) Handle(msg *pb.AlgorithmMessage) {
+	mk.mu.Lock()
+	s := mk.lock(msg.Lock)
+	req := mkReq{node: msg.NodeId, ts: msg.Sequence}
+	var out []mkMessage
+	switch msg.Kind {
+	case mkRequest:
+		out = s.receiveRequest(req)
+	case mkRelinquish:
+		if s.voted != nil && *s.voted == req {
+			s.queue = insertRequest(s.queue, mkQueued{mkReq: req, failed: true})
+			s.voted = nil
+			out = s.vote()
+		}
+	case mkRelease:
+		if s.voted != nil && *s.voted == req {
+			s.voted = nil
+			out = s.vote()
+		} else {
+			s.queue = slices.DeleteFunc(s.queue, func(q mkQueued) bool { return q.mkReq == req })
+		}
+	case mkLocked, mkFailed, mkInquire:
+		if s.request == nil || s.request.ts != msg.Sequence {
+			// For a request we no longer have; our RELEASE is on its way.
+			break
+		}
+		out = s.receiveAnswer(msg.Kind, msg.NodeId)
+		if !s.inCS && len(s.votes) == len(s.quorum) {
+			s.inCS = true
+			close(s.entered)
+		}
+	default:
+		mk.n.logf("Node %s ignoring unknown %s message %s", mk.n.ID, mk.Name(), msg.Kind)
+	}
+	mk.mu.Unlock()
+
+	for _, m := range out {
+		mk.n.Post(m.to, &pb.AlgorithmMessage{Kind: m.kind, Lock: msg.Lock, Sequence: m.ts})
+	}
+}
+
+func (mk *maekawa) State(name string) string {
+	mk.mu.Lock()
+	defer mk.mu.Unlock()
+
+	s, ok := mk.locks[name]
+	if !ok {
+		return ""
+	}
+	var state []string
+	if s.request != nil && !s.inCS {
+		state = append(state, fmt.Sprintf("%d of %d votes", len(s.votes), len(s.quorum)))
+	}
+	if s.voted != nil {
+		state = append(state, fmt.Sprintf("voted for %s, %d queued", s.voted.node, len(s.queue)))
+	}
+	return strings.Join(state, "; ")
+}
+
+// receiveRequest handles a request for our vote. A request we already voted
+// for or queued is a retry of Send and is ignored. Must be called with mu
+// held.
+func (s *mkLock) receiveRequest(req mkReq) []mkMessage {
+	if (s.voted != nil && *s.voted == req) || slices.ContainsFunc(s.queue, func(q mkQueued) bool { return q.mkReq == req }) {
+		return nil
+	}
+	if s.voted == nil && len(s.queue) == 0 {
+		s.voted = &req
+		return []mkMessage{{req.node, mkLocked, req.ts}}
+	}
+	s.queue = insertRequest(s.queue, mkQueued{mkReq: req})
+	return s.challenge()
+}
+
+// vote gives our vote to the earliest waiting request, if any. Must be called
+// with mu held.
+func (s *mkLock) vote() []mkMessage {
+	s.inquired = false
+	if len(s.queue) == 0 {
+		return nil
+	}
+	next := s.queue[0].mkReq
+	s.queue = s.queue[1:]
+	s.voted = &next
+	return append([]mkMessage{{next.node, mkLocked, next.ts}}, s.challenge()...)
+}
+
+// challenge tells every waiting request that cannot get our vote next that it
+// failed, and asks for our vote back if the earliest waiting request comes
+// before the one that has it. Must be called with mu held.
+func (s *mkLock) challenge() []mkMessage {
+	var out []mkMessage
+	for i := range s.queue {
+		q := &s.queue[i]
+		contender := i == 0 && s.voted != nil && q.before(*s.voted)
+		if contender {
+			if !s.inquired {
+				s.inquired = true
+				out = append(out, mkMessage{s.voted.node, mkInquire, s.voted.ts})
+			}
+		} else if !q.failed {
+			q.failed = true
+			out = append(out, mkMessage{q.node, mkFailed, q.ts})
+		}
+	}
+	return out
+}
+
+// receiveAnswer handles a voter's answer to our request. A vote is only given
+// back while the request is not in the critical section and some other voter
+// has told it that it cannot win yet. Must be called with mu held.
+func (s *mkLock) receiveAnswer(kind, voter string) []mkMessage {
+	switch kind {
+	case mkLocked:
+		s.votes[voter] = true
+	case mkFailed:
+		s.failed = true
+	case mkInquire:
+		s.inquiries[voter] = true
+	}
+	if s.inCS || !s.failed {
+		return nil
+	}
+
+	var out []mkMessage
+	for voter := range s.inquiries {
+		if s.votes[voter] {
+			delete(s.votes, voter)
+			delete(s.inquiries, voter)
+			out = append(out, mkMessage{voter, mkRelinquish, s.request.ts})
+		}
+	}
+	return out
+}
+
+// Leave has nothing to hand over: votes are given back by Release.
+func (mk *maekawa) Leave() {}
+
+func insertRequest(queue []mkQueued, q mkQueued) []mkQueued {
+	i := sort.Search(len(queue), func(i int) bool { return q.before(queue[i].mkReq) })
+	return slices.Insert(queue, i, q)
+}
+
+// votingSet returns the voting set of self among members. When the number of
+// members is q*q+q+1 for a prime q, the sets are the lines of the finite
+// projective plane of order q, about sqrt(N) members each. Otherwise the
+// members are laid out row by row in a grid of ceil(sqrt(N)) columns and the
+// set is one's row and column, about 2*sqrt(N) members. Every node must
+// know the same members for the sets to intersect.
+func votingSet(members []string, self string) []string {
+	members = slices.Clone(members)
+	slices.Sort(members)
+	members = slices.Compact(members)
+	me := slices.Index(members, self)
+
+	var set []int
+	if lines := projectivePlane(len(members)); lines != nil {
+		set = lines[me]
+	} else {
+		set = gridSet(len(members), me)
+	}
+
+	ids := make([]string, len(set))
+	for i, m := range set {
+		ids[i] = members[m]
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+// gridSet returns the row and column of member me in a grid of n members.
+// With only the last row incomplete, the row of one member and the column of
+// another always meet in a member of a complete row.
+func gridSet(n, me int) []int {
+	cols := int(math.Ceil(math.Sqrt(float64(n))))
+	row, col := me/cols, me%cols
+	var set []int
+	for i := 0; i < n; i++ {
+		if i/cols == row || i%cols == col {
+			set = append(set, i)
+		}
+	}
+	return set
+}
+
+// projectivePlane returns, for each of n = q*q+q+1 points of the projective
+// plane over GF(q), a distinct line through it, as the points on that line.
+// Any two lines meet in exactly one point. It returns nil if n is not of that
+// form for a prime q.
+func projectivePlane(n int) [][]int {
+	q := 2
+	for q*q+q+1 < n {
+		q++
+	}
+	if q*q+q+1 != n || !isPrime(q) {
+		return nil
+	}
+
+	// Points and lines are the same normalized triples over GF(q); a point
+	// lies on a line when their dot product is 0.
+	var triples [][3]int
+	for a := 0; a < q; a++ {
+		for b := 0; b < q; b++ {
+			triples = append(triples, [3]int{1, a, b})
+		}
+	}
+	for b := 0; b < q; b++ {
+		triples = append(triples, [3]int{0, 1, b})
+	}
+	triples = append(triples, [3]int{0, 0, 1})
+
+	on := func(p, l int) bool {
+		x, y := triples[p], triples[l]
+		return (x[0]*y[0]+x[1]*y[1]+x[2]*y[2])%q == 0
+	}
+
+	// Every point is on q+1 lines and every line has q+1 points, so there is
+	// a perfect matching of points to lines through them (Hall's theorem).
+	lineOf := make([]int, n)
+	pointOf := make([]int, n)
+	for i := range pointOf {
+		lineOf[i], pointOf[i] = -1, -1
+	}
+	var augment func(p int, seen []bool) bool
+	augment = func(p int, seen []bool) bool {
+		for l := 0; l < n; l++ {
+			if !on(p, l) || seen[l] {
+				continue
+			}
+			seen[l] = true
+			if pointOf[l] < 0 || augment(pointOf[l], seen) {
+				lineOf[p], pointOf[l] = l, p
+				return true
+			}
+		}
+		return false
+	}
+	for p := 0; p < n; p++ {
+		augment(p, make([]bool, n))
+	}
+
+	sets := make([][]int, n)
+	for p := 0; p < n; p++ {
+		for x := 0; x < n; x++ {
+			if on(x, lineOf[p]) {
+				sets[p] = append(sets[p], x)
+			}
+		}
+	}
+	return sets
+}
+
+func isPrime(q int) bool {
+	for d := 2; d*d <= q; d++ {
+		if q%d == 0 {
+			return false
+		}
+	}
+	return q >= 2
+}
@@ -0,0 +1,57 @@
+package peer
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+)
+
+// Maekawa is only safe if every two voting sets share a member.
+func TestVotingSetsIntersect(t *testing.T) {
+	tests := []struct {
+		members          int
+		minSize, maxSize int
+	}{
+		// Projective planes of order 2, 3 and 5: lines of q+1 points.
+		{7, 3, 3},
+		{13, 4, 4},
+		{31, 6, 6},
+		// Full grids: a row and a column.
+		{4, 3, 3},
+		{9, 5, 5},
+		{16, 7, 7},
+		{12, 6, 6},
+		// Grids with an incomplete last row.
+		{2, 2, 2},
+		{3, 2, 3},
+		{5, 3, 4},
+		{10, 4, 6},
+		{21, 5, 9}, // q*q+q+1 for q = 4, which is not prime
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.members), func(t *testing.T) {
+			members := make([]string, tt.members)
+			for i := range members {
+				members[i] = fmt.Sprintf("node%02d", i)
+			}
+			sets := make(map[string][]string)
+			for _, m := range members {
+				set := votingSet(members, m)
+				if !slices.Contains(set, m) {
+					t.Errorf("set of %s %v does not contain it", m, set)
+				}
+				if len(set) < tt.minSize || len(set) > tt.maxSize {
+					t.Errorf("set of %s has %d members, want %d to %d", m, len(set), tt.minSize, tt.maxSize)
+				}
+				sets[m] = set
+			}
+			for _, a := range members {
+				for _, b := range members {
+					if !slices.ContainsFunc(sets[a], func(id string) bool { return slices.Contains(sets[b], id) }) {
+						t.Errorf("sets of %s %v and %s %v do not intersect", a, sets[a], b, sets[b])
+					}
+				}
+			}
+		})
+	}
+}
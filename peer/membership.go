@@ -0,0 +1,192 @@
+package peer
+
+import (
+	"context"
+	"fmt"
+	pb "mutex/stc"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// --- Server functions ---
+
+// Join adds the caller to our peers and tells it every member we know of.
+// A newcomer is not part of any request already in flight here; RequestAccess
+// defers it until such a request is done, so it cannot overtake a request
+// that never asked it for permission.
+func (n *Node) Join(ctx context.Context, req *pb.JoinRequest) (*pb.JoinResponse, error) {
+	if n.fixedMembership() {
+		return nil, status.Errorf(codes.FailedPrecondition, "node %s runs %s, which does not let %s join", n.ID, n.Config.Algorithm, req.NodeId)
+	}
+	if req.NodeId == n.ID {
+		return nil, fmt.Errorf("node %s cannot join itself", req.NodeId)
+	}
+	if err := n.ConnectToPeer(req.NodeId, req.Address); err != nil {
+		return nil, err
+	}
+	n.PeerMu.Lock()
+	n.peerInfo[req.NodeId].joined = true
+	n.PeerMu.Unlock()
+	n.logf("Node %s added member %s at %s", n.ID, req.NodeId, req.Address)
+
+	return &pb.JoinResponse{Members: n.Members()}, nil
+}
+
+// Leave removes the caller from our peers. Any reply still pending from it is
+// no longer needed, and any reply we owe it is dropped.
+func (n *Node) Leave(ctx context.Context, req *pb.LeaveRequest) (*pb.LeaveResponse, error) {
+	if n.fixedMembership() {
+		return nil, status.Errorf(codes.FailedPrecondition, "node %s runs %s, which does not let %s leave", n.ID, n.Config.Algorithm, req.NodeId)
+	}
+	n.removePeer(req.NodeId)
+	n.logf("Node %s removed member %s", n.ID, req.NodeId)
+	return &pb.LeaveResponse{}, nil
+}
+
+// --- client functions ---
+
+// JoinCluster announces this node to the member at seedAddr, connects to every
+// member the seed knows and announces itself to each of them as well. It must
+// be called once the node is serving, and be followed by Ready. It fails
+// with ErrFixedMembership if the algorithm does not allow it.
+func (n *Node) JoinCluster(ctx context.Context, seedAddr string) error {
+	if n.fixedMembership() {
+		return ErrFixedMembership
+	}
+	conn, err := grpc.NewClient(seedAddr, n.dialOption(""))
+	if err != nil {
+		return fmt.Errorf("failed to connect to seed %s: %v", seedAddr, err)
+	}
+	defer conn.Close()
+
+	n.PeerMu.Lock()
+	n.joined = true
+	n.PeerMu.Unlock()
+	self := &pb.JoinRequest{NodeId: n.ID, Address: n.Address}
+	resp, err := pb.NewMutexServiceClient(conn).Join(ctx, self)
+	if err != nil {
+		return fmt.Errorf("failed to join via %s: %v", seedAddr, err)
+	}
+
+	// Walk the member lists until no new member turns up, so members the seed
+	// learned about while we were joining are not missed.
+	announced := map[string]bool{n.ID: true}
+	queue := resp.Members
+	for len(queue) > 0 {
+		m := queue[0]
+		queue = queue[1:]
+		if announced[m.NodeId] {
+			continue
+		}
+		announced[m.NodeId] = true
+
+		if err := n.ConnectToPeer(m.NodeId, m.Address); err != nil {
+			return err
+		}
+		n.PeerMu.RLock()
+		client := n.Peers[m.NodeId]
+		n.PeerMu.RUnlock()
+
+		joined, err := client.Join(ctx, self)
+		if err != nil {
+			return fmt.Errorf("failed to announce to %s: %v", m.NodeId, err)
+		}
+		queue = append(queue, joined.Members...)
+	}
+
+	n.logf("Node %s joined cluster with %d peers", n.ID, len(announced)-1)
+	return nil
+}
+
+// LeaveCluster stops new acquisitions, waits for every lock to be released,
+// answers every deferred request and tells all peers to forget this node.
+// Acquire fails with ErrLeft afterwards. It fails with ErrFixedMembership
+// if the algorithm does not allow it.
+func (n *Node) LeaveCluster(ctx context.Context) error {
+	if n.fixedMembership() {
+		return ErrFixedMembership
+	}
+	n.ReqMu.Lock()
+	n.left = true
+	n.ReqMu.Unlock()
+
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for n.busyLocks() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	// Nothing is wanted or held any more, so hand off every deferred reply
+	// and token before the peers stop listening to us.
+	if algo := n.algorithm(); algo != nil {
+		algo.Leave()
+	}
+
+	n.PeerMu.RLock()
+	clients := make(map[string]pb.MutexServiceClient, len(n.Peers))
+	for id, client := range n.Peers {
+		clients[id] = client
+	}
+	n.PeerMu.RUnlock()
+
+	for id, client := range clients {
+		if _, err := client.Leave(ctx, &pb.LeaveRequest{NodeId: n.ID}); err != nil {
+			n.logf("Node %s failed to tell %s it is leaving: %v", n.ID, id, err)
+		}
+		n.removePeer(id)
+	}
+
+	n.logf("Node %s left the cluster", n.ID)
+	return nil
+}
+
+// fixedMembership reports whether the algorithm builds its structure once
+// from the members known at Ready, so that a node joining or leaving would
+// break it: a joiner could make itself the root of a second tree, or get a
+// voting set that misses those of the others.
+func (n *Node) fixedMembership() bool {
+	return n.Config.Algorithm == AlgorithmRaymond || n.Config.Algorithm == AlgorithmMaekawa
+}
+
+// Members lists every known member, this node included.
+func (n *Node) Members() []*pb.Member {
+	n.PeerMu.RLock()
+	defer n.PeerMu.RUnlock()
+
+	members := []*pb.Member{{NodeId: n.ID, Address: n.Address}}
+	for id, info := range n.peerInfo {
+		members = append(members, &pb.Member{NodeId: id, Address: info.address})
+	}
+	return members
+}
+
+// removePeer forgets peerID entirely: its connection, its detector state, the
+// reply we were waiting for and the replies we owed it.
+func (n *Node) removePeer(peerID string) {
+	n.PeerMu.Lock()
+	info, ok := n.peerInfo[peerID]
+	delete(n.Peers, peerID)
+	delete(n.peerInfo, peerID)
+	n.PeerMu.Unlock()
+	if ok {
+		info.conn.Close()
+	}
+
+	n.ReqMu.Lock()
+	defer n.ReqMu.Unlock()
+	for _, ls := range n.locks {
+		if ls.round != nil {
+			ls.round.drop(peerID)
+		}
+		for _, req := range ls.forgetPeer(peerID) {
+			n.persistLater(walRecord{Op: walAnswer, Lock: req.Lock, Node: req.NodeId, RequestID: req.RequestId})
+		}
+	}
+}
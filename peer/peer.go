@@ -3,167 +3,258 @@ package peer
 import (
 	"container/list"
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
-	"log"
 	pb "mutex/stc"
 	"sync"
 	"time"
 
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
 )
 
+// Config holds the tunables of a Node. NewNode starts from DefaultConfig and
+// fields may be changed until Start is called.
+type Config struct {
+	HeartbeatInterval time.Duration // how often every peer is pinged
+	SuspectPhi        float64       // phi above which a peer is logged as suspected
+	FailureTimeout    time.Duration // silence after which a peer is considered dead
+	LeaseGrace        time.Duration // extra wait on top of a holder's lease for clock drift and delays
+	Algorithm         string        // AlgorithmRicartAgrawala, AlgorithmSuzukiKasami, ...
+	// Tree maps each node to its parent in the spanning tree of
+	// AlgorithmRaymond. Empty means a binary tree over the sorted member IDs.
+	Tree map[string]string
+	// Clock is ClockLamport or ClockHLC, the clock kept in LamportClock.
+	Clock string
+	// VectorClock keeps a vector clock next to the Lamport clock, sends it
+	// with every message and appends it to every log line.
+	VectorClock bool
+	// TLS secures the traffic between nodes with mutual TLS, see LoadTLS.
+	// Nil means plain connections on which any caller may claim any node ID.
+	TLS *tls.Config
+	// WALDir is where the node keeps its write-ahead log, which lets it
+	// restart without breaking the promises of its previous run. Empty keeps
+	// no log.
+	WALDir string
+}
+
+func DefaultConfig() Config {
+	return Config{
+		HeartbeatInterval: time.Second,
+		SuspectPhi:        8,
+		FailureTimeout:    10 * time.Second,
+		LeaseGrace:        time.Second,
+		Algorithm:         AlgorithmRicartAgrawala,
+		Clock:             ClockLamport,
+	}
+}
+
 type Node struct {
-	ID                string
-	Address           string
-	Peers             map[string]pb.MutexServiceClient
-	LamportClock      uint64
-	WantCS            bool // state == WANTED;
-	InCS              bool // state == HELD; state == RELEASED if neither is true;
-	DeferredResponses *list.List
-	ResponseCount     int
-	CurrentRequest    *pb.AccessRequest
-	ReqMu             sync.Mutex
-	LamMu             sync.Mutex
-	CsMu              sync.Mutex
-	Release           (chan bool)
+	ID            string
+	Address       string
+	Incarnation   uint64 // set by Start, tells this run of the node from earlier and later ones
+	Config        Config
+	Peers         map[string]pb.MutexServiceClient
+	PeerMu        sync.RWMutex // guards Peers, peerInfo and joined
+	peerInfo      map[string]*peerInfo
+	LamportClock  uint64
+	ReqMu         sync.Mutex // guards locks, nextRequestID and left
+	LamMu         sync.Mutex
+	locks         map[string]*lockState // per-lock protocol state, created on demand
+	nextRequestID uint64
+	left          bool           // set by LeaveCluster
+	joined        bool           // set by JoinCluster
+	algo          MutexAlgorithm // set by Start, see algorithm
+	wal           *wal           // set by Start when Config.WALDir is set
+
+	started        chan struct{} // closed by Start once algo is set
+	readyOnce      sync.Once
+	ready          chan struct{} // closed by Ready
+	founding       bool          // set by Ready, see founder
+	initialMembers []string      // set by Ready: the members known then, this node included
+
+	incarnationMu sync.Mutex // serializes checkIncarnation
+
+	outboxMu sync.Mutex                           // guards outbox
+	outbox   map[string]chan *pb.AlgorithmMessage // per-peer FIFO queues of post
+
+	vcMu        sync.Mutex        // guards vectorClock
+	vectorClock map[string]uint64 // maintained when Config.VectorClock is set
+
+	statsMu       sync.Mutex // guards messagesSent and messagesSaved
+	messagesSent  uint64     // protocol messages sent, for Status
+	messagesSaved uint64     // messages not needed thanks to kept permissions
 	pb.UnimplementedMutexServiceServer
 }
 
+var (
+	// ErrNotHeld is returned by Release when this node does not hold the lock.
+	ErrNotHeld = errors.New("lock not held")
+	// ErrLeft is returned by Acquire once the node has left the cluster.
+	ErrLeft = errors.New("node has left the cluster")
+	// ErrLeaseExpired is returned by Release and Renew when the lease ran out
+	// and the lock was released on the holder's behalf.
+	ErrLeaseExpired = errors.New("lease expired, lock was lost")
+	// ErrWouldBlock is returned by TryAcquire when the lock is not free.
+	ErrWouldBlock = errors.New("lock is not free")
+	// ErrSharedSemaphore is returned when a semaphore is taken in shared mode.
+	ErrSharedSemaphore = errors.New("semaphores cannot be taken in shared mode")
+	// ErrNotReady is returned by Acquire before Node.Start and Node.Ready
+	// have been called.
+	ErrNotReady = errors.New("node is not ready")
+	// ErrFixedMembership is returned by JoinCluster and LeaveCluster when the
+	// algorithm builds its structure from the members the nodes started
+	// with, as AlgorithmRaymond and AlgorithmMaekawa do.
+	ErrFixedMembership = errors.New("the algorithm does not allow membership changes")
+	// ErrUnsupported is returned when the algorithm the node runs cannot take
+	// the lock as asked, e.g. in shared mode or with a lease.
+	ErrUnsupported = errors.New("not supported by the algorithm")
+)
+
 // --- initialization functions ---
 func NewNode(id, address string) *Node {
 	return &Node{
-		ID:                id,
-		Address:           address,
-		Peers:             make(map[string]pb.MutexServiceClient),
-		LamportClock:      0,
-		DeferredResponses: list.New(),
-		Release:           make(chan bool, 1),
+		ID:           id,
+		Address:      address,
+		Config:       DefaultConfig(),
+		Peers:        make(map[string]pb.MutexServiceClient),
+		peerInfo:     make(map[string]*peerInfo),
+		LamportClock: 0,
+		locks:        make(map[string]*lockState),
+		outbox:       make(map[string]chan *pb.AlgorithmMessage),
+		started:      make(chan struct{}),
+		ready:        make(chan struct{}),
 	}
 }
 
 func (n *Node) ConnectToPeer(peerID, peerAddr string) error {
-	conn, err := grpc.NewClient(peerAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	n.PeerMu.RLock()
+	known, ok := n.peerInfo[peerID]
+	n.PeerMu.RUnlock()
+	if ok && known.address == peerAddr {
+		return nil
+	}
+
+	conn, err := grpc.NewClient(peerAddr, n.dialOption(peerID))
 	if err != nil {
 		return fmt.Errorf("failed to connect to peer %s: %v", peerID, err)
 	}
 
+	n.PeerMu.Lock()
+	if old, ok := n.peerInfo[peerID]; ok {
+		old.conn.Close()
+	}
 	n.Peers[peerID] = pb.NewMutexServiceClient(conn)
-	log.Printf("Node %s connected to peer %s at %s", n.ID, peerID, peerAddr)
+	n.peerInfo[peerID] = &peerInfo{
+		address:  peerAddr,
+		conn:     conn,
+		detector: newPhiDetector(n.Config.HeartbeatInterval, time.Now()),
+	}
+	n.PeerMu.Unlock()
+	n.logf("Node %s connected to peer %s at %s", n.ID, peerID, peerAddr)
 	return nil
 }
 
 // --- Server functions ---
 func (n *Node) RequestAccess(ctx context.Context, req *pb.AccessRequest) (*pb.AccessResponse, error) {
-	n.ReqMu.Lock()
-	defer n.ReqMu.Unlock()
-
-	// Update Lamport clock on message receipt
-	timestamp := n.UpdateLamportClock(req.LamportTimestamp)
-
-	log.Printf("Node %s received request from %s with Lamport timestamp %d", n.ID, req.NodeId, req.LamportTimestamp)
-
-	if n.InCS || (n.WantCS && n.isHigherPriority(n.CurrentRequest, req)) {
-		n.DeferredResponses.PushBack(req.NodeId)
-		log.Printf("Node %s deferring response to %s", n.ID, req.NodeId)
-		return &pb.AccessResponse{Granted: false, LamportTimestamp: timestamp}, nil
+	pa, err := n.permissions()
+	if err != nil {
+		return nil, err
 	}
-
-	defer n.SendReleaseMSG(req.NodeId, n.Peers[req.NodeId], timestamp) // actual message that matters
-	return &pb.AccessResponse{Granted: false, LamportTimestamp: timestamp}, nil
+	if err := n.checkIncarnation(req.NodeId, req.Incarnation); err != nil {
+		return nil, err
+	}
+	return pa.HandleRequest(req)
 }
 
 func (n *Node) ReleaseAccess(ctx context.Context, req *pb.ReleaseRequest) (*pb.ReleaseResponse, error) {
-
-	// Update Lamport clock on release message
-	timestamp := n.UpdateLamportClock(req.LamportTimestamp)
-
-	log.Printf("Node %s received release from %s with Lamport timestamp %d", n.ID, req.NodeId, req.LamportTimestamp)
-	n.Release <- true
-
-	return &pb.ReleaseResponse{Acknowledged: true, LamportTimestamp: timestamp}, nil
+	pa, err := n.permissions()
+	if err != nil {
+		return nil, err
+	}
+	if err := n.checkIncarnation(req.NodeId, req.Incarnation); err != nil {
+		return nil, err
+	}
+	return pa.HandleRelease(req), nil
 }
 
 // --- client functions ---
-func (n *Node) RequestCriticalSection() {
-	n.CsMu.Lock()
-	defer n.CsMu.Unlock()
-	if n.InCS || n.WantCS {
-		return
-	}
-
-	n.WantCS = true
-	timestamp := n.GetLamportClock()
-	n.CurrentRequest = &pb.AccessRequest{
-		NodeId:           n.ID,
-		LamportTimestamp: timestamp,
-	}
-	n.ResponseCount = 0
 
-	log.Printf("Node %s requesting critical section access with Lamport timestamp %d", n.ID, timestamp)
+// Acquire takes DefaultLock. See Lock.Acquire.
+func (n *Node) Acquire(ctx context.Context) error {
+	return n.Lock(DefaultLock).Acquire(ctx)
+}
 
-	responses := make(chan bool, len(n.Peers))
+// Release releases DefaultLock. See Lock.Release.
+func (n *Node) Release() error {
+	return n.Lock(DefaultLock).Release()
+}
 
-	// Request access from all peers
-	for peerID, client := range n.Peers {
-		go func(id string, c pb.MutexServiceClient) {
-			log.Printf("Requesting access from %s", peerID)
-			resp, err := c.RequestAccess(context.Background(), n.CurrentRequest)
+// WithLock runs fn while holding DefaultLock. See Lock.WithLock.
+func (n *Node) WithLock(ctx context.Context, fn func() error) error {
+	return n.Lock(DefaultLock).WithLock(ctx, fn)
+}
 
-			if err != nil {
-				log.Printf("Error requesting access from %s: %v", id, err)
-				responses <- false
-				return
-			}
-			log.Printf("Finished requesting access from %s", peerID)
-			n.UpdateLamportClock(resp.LamportTimestamp)
-			responses <- <-n.Release
+// ExecuteCriticalSection is the demo workload run by main while holding the lock.
+func (n *Node) ExecuteCriticalSection() error {
+	// Simulate critical section work
+	time.Sleep(2 * time.Second)
+	return nil
+}
 
-		}(peerID, client)
+func (n *Node) sendDeferredResponses(deferred *list.List, releaseTimestamp uint64) {
+	// Send release to all peers in defered
+	n.logf("Node %s sending %d Defered responses with %s", n.ID, deferred.Len(), n.stamp(releaseTimestamp))
+	for e := deferred.Front(); e != nil; e = e.Next() {
+		req := e.Value.(*pb.AccessRequest)
+		n.PeerMu.RLock()
+		client := n.Peers[req.NodeId]
+		n.PeerMu.RUnlock()
+		n.SendReleaseMSG(req.NodeId, req.Lock, req.RequestId, req.Incarnation, client, releaseTimestamp)
+		n.persistLater(walRecord{Op: walAnswer, Lock: req.Lock, Node: req.NodeId, RequestID: req.RequestId})
 	}
+}
 
-	// Wait for all responses
-	log.Printf("Node %s is waiting for %d releases", n.ID, len(n.Peers))
-	granted := 0
-	needed := len(n.Peers)
+// sendRequest delivers req to a peer, retrying until it answers, is declared
+// dead by the failure detector or ctx is done. Retries reuse the request ID so
+// the peer queues us at most once.
+func (n *Node) sendRequest(ctx context.Context, peerID string, client pb.MutexServiceClient, req *pb.AccessRequest) (*pb.AccessResponse, error) {
+	for {
+		resp, err := client.RequestAccess(ctx, req)
+		if err == nil {
+			return resp, nil
+		}
+		n.logf("Error requesting access from %s: %v", peerID, err)
 
-	for i := 0; i < needed; i++ {
-		if <-responses {
-			granted++
+		if n.PeerState(peerID) == PeerDead {
+			return nil, fmt.Errorf("peer %s is dead", peerID)
+		}
+		select {
+		case <-time.After(n.Config.HeartbeatInterval):
+		case <-ctx.Done():
+			return nil, ctx.Err()
 		}
 	}
-
-	n.ExecuteCriticalSection()
-
 }
 
-func (n *Node) ExecuteCriticalSection() {
-
-	log.Printf("Node %s entering critical section with Lamport timestamp %d", n.ID, n.LamportClock)
-	n.InCS = true
-	// Simulate critical section work
-	time.Sleep(2 * time.Second)
-
-	n.InCS = false
-	n.WantCS = false
-	releaseTimestamp := n.GetLamportClock()
-
-	log.Printf("Node %s leaving critical section with Lamport timestamp %d", n.ID, releaseTimestamp)
-
-	// Send release to all peers in defered
-	log.Printf("Node %s sending %d Defered responses with Lamport timestamp %d", n.ID, n.DeferredResponses.Len(), releaseTimestamp)
-	for n.DeferredResponses.Len() > 0 {
-		front := n.DeferredResponses.Front()
+// --- util functions ---
 
-		peerID := front.Value.(string)
-		client := n.Peers[peerID]
-		n.SendReleaseMSG(peerID, client, releaseTimestamp)
+// livePeers returns the clients of every peer not currently considered dead.
+func (n *Node) livePeers() map[string]pb.MutexServiceClient {
+	n.PeerMu.RLock()
+	defer n.PeerMu.RUnlock()
 
-		n.DeferredResponses.Remove(front)
+	peers := make(map[string]pb.MutexServiceClient, len(n.Peers))
+	for id, client := range n.Peers {
+		if info, ok := n.peerInfo[id]; ok && info.state == PeerDead {
+			n.logf("Node %s not asking dead peer %s", n.ID, id)
+			continue
+		}
+		peers[id] = client
 	}
+	return peers
 }
 
-// --- util functions ---
 func (n *Node) UpdateLamportClock(msgTimestamp uint64) uint64 {
 	n.LamMu.Lock()
 	// Same as: clock = max(local_clock, msg_timestamp) + 1
@@ -171,15 +262,23 @@ func (n *Node) UpdateLamportClock(msgTimestamp uint64) uint64 {
 		n.LamportClock = msgTimestamp
 	}
 	n.LamportClock++
+	if n.Config.Clock == ClockHLC {
+		n.LamportClock = max(n.LamportClock, hlcNow())
+	}
+	clock := n.LamportClock
 	n.LamMu.Unlock()
-	return n.LamportClock
+	return clock
 }
 
 func (n *Node) GetLamportClock() uint64 {
 	n.LamMu.Lock()
 	n.LamportClock++
+	if n.Config.Clock == ClockHLC {
+		n.LamportClock = max(n.LamportClock, hlcNow())
+	}
+	clock := n.LamportClock
 	n.LamMu.Unlock()
-	return n.LamportClock
+	return clock
 }
 
 func (n *Node) isHigherPriority(req1, req2 *pb.AccessRequest) bool {
@@ -192,13 +291,25 @@ func (n *Node) isHigherPriority(req1, req2 *pb.AccessRequest) bool {
 	return req1.LamportTimestamp < req2.LamportTimestamp
 }
 
-func (n *Node) SendReleaseMSG(peerID string, client pb.MutexServiceClient, releaseTimestamp uint64) {
-	_, err := client.ReleaseAccess(context.Background(), &pb.ReleaseRequest{
-		NodeId:           n.ID,
-		LamportTimestamp: releaseTimestamp,
+func (n *Node) SendReleaseMSG(peerID, lock string, requestID, requestIncarnation uint64, client pb.MutexServiceClient, releaseTimestamp uint64) {
+	if client == nil {
+		n.logf("Node %s dropping release to %s: no longer a member", n.ID, peerID)
+		return
+	}
+	n.countMessages(1, 0)
+	resp, err := client.ReleaseAccess(context.Background(), &pb.ReleaseRequest{
+		NodeId:             n.ID,
+		LamportTimestamp:   releaseTimestamp,
+		RequestId:          requestID,
+		Lock:               lock,
+		VectorClock:        n.tickVector(),
+		Incarnation:        n.Incarnation,
+		RequestIncarnation: requestIncarnation,
 	})
 	if err != nil {
-		log.Printf("Error sending release to %s: %v", peerID, err)
+		n.logf("Error sending release to %s: %v", peerID, err)
+	} else {
+		n.mergeVector(resp.VectorClock)
 	}
-	log.Printf("Node %s granting %s access to CS", n.ID, peerID)
+	n.logf("Node %s granting %s access to lock %s", n.ID, peerID, lock)
 }
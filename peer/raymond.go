@@ -0,0 +1,231 @@
+package peer
+
+import (
+	"context"
+	"fmt"
+	pb "mutex/stc"
+	"slices"
+	"sync"
+)
+
+// Kinds of Raymond messages.
+const (
+	rayRequest   = "REQUEST"   // to the neighbour towards the token: someone behind me wants it
+	rayPrivilege = "PRIVILEGE" // the token itself
+)
+
+// raymond is Raymond's tree algorithm. The nodes form a spanning tree, and
+// every node points at the neighbour in the direction of the token. Requests
+// travel along those pointers towards the token and the token travels back
+// along the same path, reversing the pointers as it goes, so an entry costs
+// O(log N) messages on a balanced tree. Requires exclusive mode, one permit
+// and no lease.
+type raymond struct {
+	n      *Node
+	mu     sync.Mutex // guards everything below
+	placed bool       // parent is known
+	parent string     // our parent in the tree, "" at the root
+	locks  map[string]*rayLock
+}
+
+// rayLock is the Raymond state of one lock.
+type rayLock struct {
+	holder  string   // neighbour towards the token, or ourselves if we have it
+	queue   []string // neighbours, and ourselves, waiting for the token in order
+	asked   bool     // a request for the head of queue has been sent to holder
+	using   bool     // we are in the critical section
+	waiting chan struct{}
+}
+
+// rayMessage is a message to post once mu is released.
+type rayMessage struct {
+	to   string
+	kind string
+}
+
+func newRaymond(n *Node) (MutexAlgorithm, error) {
+	// A configured tree can be checked right away; the default one depends on
+	// the members, which are only known once the node is connected.
+	if len(n.Config.Tree) > 0 {
+		if _, err := treeParent(n.Config.Tree, nil, n.ID); err != nil {
+			return nil, err
+		}
+	}
+	return &raymond{n: n, locks: make(map[string]*rayLock)}, nil
+}
+
+func (r *raymond) Name() string {
+	return AlgorithmRaymond
+}
+
+// lock returns the state of name, creating it on first use. The root of the
+// tree starts with the token and everybody else points at their parent. The
+// default tree is built over the members the node knew when it became ready,
+// so that members connecting late cannot move it. Must be called with mu
+// held, and only after Node.Ready.
+func (r *raymond) lock(name string) *rayLock {
+	if !r.placed {
+		r.parent, _ = treeParent(r.n.Config.Tree, r.n.initialMembers, r.n.ID)
+		r.placed = true
+	}
+	s, ok := r.locks[name]
+	if !ok {
+		s = &rayLock{holder: r.parent}
+		if r.parent == "" {
+			r.n.logf("Node %s is the root and creates the token for lock %s", r.n.ID, name)
+			s.holder = r.n.ID
+		}
+		r.locks[name] = s
+	}
+	return s
+}
+
+func (r *raymond) Request(ctx context.Context, req *Request) error {
+	if err := exclusiveOnly(req); err != nil {
+		return err
+	}
+	name := req.Lock
+	r.mu.Lock()
+	s := r.lock(name)
+	waiting := make(chan struct{})
+	s.waiting = waiting
+	s.queue = append(s.queue, r.n.ID)
+	out := r.advance(s)
+	r.mu.Unlock()
+	r.send(name, out)
+
+	select {
+	case <-waiting:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (r *raymond) Release(name string) {
+	r.mu.Lock()
+	s := r.lock(name)
+	s.using = false
+	s.waiting = nil
+	// An abandoned request leaves the queue; if the token still comes our way
+	// it is simply passed on.
+	s.queue = slices.DeleteFunc(s.queue, func(id string) bool { return id == r.n.ID })
+	out := r.advance(s)
+	r.mu.Unlock()
+	r.send(name, out)
+}
+
+func (r *raymond) Handle(msg *pb.AlgorithmMessage) {
+	r.mu.Lock()
+	s := r.lock(msg.Lock)
+	switch msg.Kind {
+	case rayRequest:
+		if !slices.Contains(s.queue, msg.NodeId) {
+			s.queue = append(s.queue, msg.NodeId)
+		}
+	case rayPrivilege:
+		s.holder = r.n.ID
+	default:
+		r.n.logf("Node %s ignoring unknown %s message %s", r.n.ID, r.Name(), msg.Kind)
+	}
+	out := r.advance(s)
+	r.mu.Unlock()
+	r.send(msg.Lock, out)
+}
+
+func (r *raymond) State(name string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s, ok := r.locks[name]
+	switch {
+	case !ok:
+		return ""
+	case s.holder == r.n.ID:
+		return fmt.Sprintf("holding the token, %d queued", len(s.queue))
+	default:
+		return fmt.Sprintf("token towards %s, %d queued", s.holder, len(s.queue))
+	}
+}
+
+// advance passes the token to the head of the queue if we have it and are
+// not using it, and otherwise asks for it on behalf of the queue. Must be
+// called with mu held.
+func (r *raymond) advance(s *rayLock) []rayMessage {
+	var out []rayMessage
+	if s.holder == r.n.ID && !s.using && len(s.queue) > 0 {
+		head := s.queue[0]
+		s.queue = s.queue[1:]
+		s.asked = false
+		if head == r.n.ID {
+			s.using = true
+			close(s.waiting)
+			s.waiting = nil
+		} else {
+			s.holder = head
+			out = append(out, rayMessage{head, rayPrivilege})
+		}
+	}
+	if s.holder != r.n.ID && len(s.queue) > 0 && !s.asked {
+		s.asked = true
+		out = append(out, rayMessage{s.holder, rayRequest})
+	}
+	return out
+}
+
+func (r *raymond) send(name string, out []rayMessage) {
+	for _, m := range out {
+		if m.kind == rayPrivilege {
+			r.n.logf("Node %s passing the token of lock %s to %s", r.n.ID, name, m.to)
+		}
+		r.n.Post(m.to, &pb.AlgorithmMessage{Kind: m.kind, Lock: name})
+	}
+}
+
+// Leave cannot repair the tree, so membership must stay fixed.
+func (r *raymond) Leave() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for name, s := range r.locks {
+		if s.holder == r.n.ID {
+			r.n.logf("Node %s leaving with the token of lock %s; the lock is lost", r.n.ID, name)
+		}
+	}
+}
+
+// treeParent returns the parent of self in the tree given as child -> parent
+// edges, or "" if self is the root. Without edges the tree is a binary heap
+// over the sorted member IDs, rooted at the smallest.
+func treeParent(tree map[string]string, members []string, self string) (string, error) {
+	if len(tree) == 0 {
+		members = slices.Clone(members)
+		slices.Sort(members)
+		i := slices.Index(members, self)
+		if i == 0 {
+			return "", nil
+		}
+		return members[(i-1)/2], nil
+	}
+
+	// Every node must reach the one root without running into a cycle.
+	var root string
+	for child := range tree {
+		seen := map[string]bool{}
+		node := child
+		for tree[node] != "" {
+			if seen[node] {
+				return "", fmt.Errorf("tree has a cycle through %s", node)
+			}
+			seen[node] = true
+			node = tree[node]
+		}
+		if root != "" && node != root {
+			return "", fmt.Errorf("tree has two roots, %s and %s", root, node)
+		}
+		root = node
+	}
+	if _, ok := tree[self]; !ok && self != root {
+		return "", fmt.Errorf("node %s is not in the tree", self)
+	}
+	return tree[self], nil
+}
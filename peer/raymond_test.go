@@ -0,0 +1,69 @@
+package peer
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+)
+
+// Every node must reach the one root, or the token can be lost or doubled.
+func TestDefaultTreeIsSpanning(t *testing.T) {
+	for n := 1; n <= 20; n++ {
+		members := make([]string, n)
+		for i := range members {
+			members[i] = fmt.Sprintf("node%02d", i)
+		}
+		shuffled := slices.Clone(members)
+		slices.Reverse(shuffled)
+
+		for _, m := range members {
+			node, depth := m, 0
+			for {
+				parent, err := treeParent(nil, shuffled, node)
+				if err != nil {
+					t.Fatalf("%d members: parent of %s: %v", n, node, err)
+				}
+				if parent == "" {
+					break
+				}
+				if !slices.Contains(members, parent) {
+					t.Fatalf("%d members: parent of %s is %q, not a member", n, node, parent)
+				}
+				node = parent
+				if depth++; depth > n {
+					t.Fatalf("%d members: %s does not reach the root", n, m)
+				}
+			}
+			if node != members[0] {
+				t.Errorf("%d members: %s reaches root %s, want %s", n, m, node, members[0])
+			}
+		}
+	}
+}
+
+func TestConfiguredTree(t *testing.T) {
+	tests := []struct {
+		name    string
+		tree    map[string]string
+		self    string
+		parent  string
+		wantErr bool
+	}{
+		{"root", map[string]string{"b": "a", "c": "a"}, "a", "", false},
+		{"leaf", map[string]string{"b": "a", "c": "b"}, "c", "b", false},
+		{"cycle", map[string]string{"b": "a", "a": "b"}, "a", "", true},
+		{"two roots", map[string]string{"b": "a", "d": "c"}, "b", "", true},
+		{"not in tree", map[string]string{"b": "a"}, "c", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parent, err := treeParent(tt.tree, []string{"a", "b", "c", "d"}, tt.self)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("treeParent(%v, %s) error = %v, want error %v", tt.tree, tt.self, err, tt.wantErr)
+			}
+			if err == nil && parent != tt.parent {
+				t.Errorf("treeParent(%v, %s) = %q, want %q", tt.tree, tt.self, parent, tt.parent)
+			}
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package peer
+
+import (
+	pb "mutex/stc"
+	"time"
+)
+
+// replyRound is the set of replies a single outgoing request is waiting for.
+// A reply only counts when it comes from a peer in the set and names the
+// round's request ID, so replies for older requests and duplicates caused by
+// retries are dropped instead of being credited to the wrong round.
+type replyRound struct {
+	requestID    uint64
+	participants map[string]bool // peers asked for permission
+	pending      map[string]bool // peers whose reply is still outstanding
+	slack        int             // replies that may still be pending on entry; k-1 for k-mutual exclusion
+	done         chan struct{}   // closed once at most slack replies are pending
+	finished     bool            // done has been closed
+	refusals     int             // peers that deferred us or could not be reached
+	refused      chan struct{}   // closed once refusals exceed slack
+
+	ask func(peerID string, client pb.MutexServiceClient) // asks one more peer, set by the request; must be called with ReqMu held
+
+	leaseDeadlines map[string]time.Time // when to stop waiting for a peer holding the lock under a lease
+}
+
+func newReplyRound(requestID uint64, peers map[string]pb.MutexServiceClient, slack int) *replyRound {
+	r := &replyRound{
+		requestID:    requestID,
+		participants: make(map[string]bool, len(peers)),
+		pending:      make(map[string]bool, len(peers)),
+		slack:        slack,
+		done:         make(chan struct{}),
+		refused:      make(chan struct{}),
+
+		leaseDeadlines: make(map[string]time.Time),
+	}
+	for id := range peers {
+		r.participants[id] = true
+		r.pending[id] = true
+	}
+	r.check()
+	return r
+}
+
+// drop stops waiting for peerID, either because it replied or because it is
+// no longer a member we need permission from.
+func (r *replyRound) drop(peerID string) {
+	if !r.pending[peerID] {
+		return
+	}
+	delete(r.pending, peerID)
+	r.check()
+}
+
+// refuse notes that a peer did not grant the request straight away.
+func (r *replyRound) refuse() {
+	r.refusals++
+	if r.refusals == r.slack+1 {
+		close(r.refused)
+	}
+}
+
+func (r *replyRound) check() {
+	if !r.finished && len(r.pending) <= r.slack {
+		r.finished = true
+		close(r.done)
+	}
+}
+
+// recordReply credits a reply from peerID to the request of ls it answers and
+// reports whether it was the current one. ls may be nil when the lock is no
+// longer in use. Must be called with ReqMu held.
+func (n *Node) recordReply(ls *lockState, peerID string, requestID uint64) bool {
+	if ls == nil || ls.round == nil || ls.round.requestID != requestID {
+		n.logf("Node %s ignoring stale reply from %s for request %d", n.ID, peerID, requestID)
+		return false
+	}
+	ls.round.drop(peerID)
+	return true
+}
+
+// deferResponse queues req until we leave the critical section. A retried
+// request is only queued once. Must be called with ReqMu held.
+func (ls *lockState) deferResponse(req *pb.AccessRequest) {
+	for e := ls.deferred.Front(); e != nil; e = e.Next() {
+		queued := e.Value.(*pb.AccessRequest)
+		if queued.NodeId == req.NodeId && queued.RequestId == req.RequestId {
+			return
+		}
+	}
+	ls.deferred.PushBack(req)
+}
+
+// forgetPeer drops every reply owed to peerID and any permission of it we
+// kept, and returns the requests it no longer answers. Must be called with
+// ReqMu held.
+func (ls *lockState) forgetPeer(peerID string) []*pb.AccessRequest {
+	delete(ls.authorized, peerID)
+	var forgotten []*pb.AccessRequest
+	for e := ls.deferred.Front(); e != nil; {
+		next := e.Next()
+		if req := e.Value.(*pb.AccessRequest); req.NodeId == peerID {
+			ls.deferred.Remove(e)
+			forgotten = append(forgotten, req)
+		}
+		e = next
+	}
+	return forgotten
+}
@@ -0,0 +1,375 @@
+package peer
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	pb "mutex/stc"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// ricartAgrawala is the Ricart-Agrawala algorithm, with Lamport timestamps
+// and per-request reply rounds, and the default algorithm of a node. It asks
+// every live peer for permission with RequestAccess and enters once all of
+// them, or all but k-1 for a semaphore, have granted it. A peer that is in the
+// critical section, or wants it with an earlier request, defers its reply
+// until it leaves and then sends it with ReleaseAccess. It is the only
+// algorithm with shared mode, semaphores and leases. Its state lives in the
+// node's lockState, since RequestAccess has to answer from it directly.
+//
+// With reuse set it is the Roucairol-Carvalho refinement: a reply is a
+// permission that stays with us until its peer asks for it back, so we only
+// ask the peers whose permission we do not hold, and repeated entries by an
+// uncontested node cost no messages at all. A peer asking for a permission
+// we hold while we want the lock with a later request gets it and is asked
+// again straight away. Requires exclusive mode, one permit and no lease.
+type ricartAgrawala struct {
+	n     *Node
+	reuse bool // keep permissions across entries (Roucairol-Carvalho)
+}
+
+// NewRicartAgrawala returns AlgorithmRicartAgrawala for n, for algorithms
+// registered with RegisterAlgorithm that build on it.
+func NewRicartAgrawala(n *Node) PermissionAlgorithm {
+	return &ricartAgrawala{n: n}
+}
+
+// NewRoucairolCarvalho returns AlgorithmRoucairolCarvalho for n, like
+// NewRicartAgrawala.
+func NewRoucairolCarvalho(n *Node) PermissionAlgorithm {
+	return &ricartAgrawala{n: n, reuse: true}
+}
+
+func newRicartAgrawala(n *Node) (MutexAlgorithm, error) {
+	return NewRicartAgrawala(n), nil
+}
+
+func newRoucairolCarvalho(n *Node) (MutexAlgorithm, error) {
+	return NewRoucairolCarvalho(n), nil
+}
+
+func (ra *ricartAgrawala) Name() string {
+	if ra.reuse {
+		return AlgorithmRoucairolCarvalho
+	}
+	return AlgorithmRicartAgrawala
+}
+
+// Request runs one round of requests for ls.current.
+func (ra *ricartAgrawala) Request(ctx context.Context, req *Request) error {
+	if ra.reuse {
+		if err := exclusiveOnly(req); err != nil {
+			return err
+		}
+	}
+	n := ra.n
+	n.ReqMu.Lock()
+	ls := n.locks[req.Lock]
+	request := ls.current
+	peers := n.livePeers()
+	kept := 0
+	for id := range peers {
+		if ls.authorized[id] {
+			delete(peers, id)
+			kept++
+		}
+	}
+	// With k permits, k-1 peers may be missing. The lowest-priority of any k+1
+	// holders would have been deferred by all k others, so it could not have
+	// collected enough replies (Raymond's k-mutual exclusion).
+	round := newReplyRound(request.RequestId, peers, req.Permits-1)
+	ls.round = round
+	round.ask = func(id string, c pb.MutexServiceClient) {
+		round.participants[id] = true
+		round.pending[id] = true
+		go ra.ask(ctx, ls, round, request, id, c, req.Try)
+	}
+	for id, client := range peers {
+		round.ask(id, client)
+	}
+	n.ReqMu.Unlock()
+	if kept > 0 {
+		n.logf("Node %s already holds the permission of %d peers for lock %s", n.ID, kept, req.Lock)
+		// Each kept permission saves a request and its reply.
+		n.countMessages(0, 2*kept)
+	}
+
+	// Wait for all responses
+	n.logf("Node %s is waiting for %d releases", n.ID, max(len(peers)-req.Permits+1, 0))
+	refused := round.refused
+	if !req.Try {
+		refused = nil // a refusal just means waiting for the deferred reply
+	}
+	leaseCheck := time.NewTicker(leaseCheckInterval)
+	defer leaseCheck.Stop()
+	for {
+		select {
+		case <-round.done:
+			return nil
+		case <-leaseCheck.C:
+			n.ReqMu.Lock()
+			n.expireLeaseDeadlines(ls)
+			n.ReqMu.Unlock()
+		case <-refused:
+			n.logf("Node %s withdrawing request %d for lock %s: would block", n.ID, request.RequestId, req.Lock)
+			ra.withdraw(request, round)
+			return ErrWouldBlock
+		case <-ctx.Done():
+			n.logf("Node %s withdrawing request %d for lock %s: %v", n.ID, request.RequestId, req.Lock, ctx.Err())
+			ra.withdraw(request, round)
+			return ctx.Err()
+		}
+	}
+
+}
+
+// ask requests access from one peer for round and credits its answer.
+func (ra *ricartAgrawala) ask(ctx context.Context, ls *lockState, round *replyRound, request *pb.AccessRequest, id string, c pb.MutexServiceClient, try bool) {
+	n := ra.n
+	n.logf("Requesting access from %s", id)
+	n.countMessages(1, 0)
+	if vc := n.tickVector(); vc != nil {
+		request = proto.Clone(request).(*pb.AccessRequest)
+		request.VectorClock = vc
+	}
+	var resp *pb.AccessResponse
+	var err error
+	if try {
+		resp, err = c.RequestAccess(ctx, request)
+	} else {
+		resp, err = n.sendRequest(ctx, id, c, request)
+	}
+	if err == nil {
+		err = n.checkIncarnation(id, resp.Incarnation)
+	}
+	if err != nil {
+		n.logf("Gave up requesting access from %s: %v", id, err)
+		n.ReqMu.Lock()
+		round.refuse()
+		n.ReqMu.Unlock()
+		return
+	}
+	n.logf("Finished requesting access from %s", id)
+	n.UpdateLamportClock(resp.LamportTimestamp)
+	n.mergeVector(resp.VectorClock)
+	n.ReqMu.Lock()
+	if resp.Granted {
+		ra.recordReply(ls, id, request.RequestId)
+	} else {
+		round.refuse()
+		if ls.round == round {
+			n.extendLeaseDeadline(round, id, resp.LeaseRemainingMs)
+		}
+	}
+	n.ReqMu.Unlock()
+}
+
+// recordReply credits a reply from peerID and, with reuse, keeps the
+// permission it carries. Must be called with ReqMu held.
+func (ra *ricartAgrawala) recordReply(ls *lockState, peerID string, requestID uint64) {
+	if ra.n.recordReply(ls, peerID, requestID) && ra.reuse {
+		ls.authorized[peerID] = true
+	}
+}
+
+// Release answers every request deferred while we wanted or held the lock.
+func (ra *ricartAgrawala) Release(lock string) {
+	n := ra.n
+	n.ReqMu.Lock()
+	ls, ok := n.locks[lock]
+	if !ok {
+		n.ReqMu.Unlock()
+		return
+	}
+	deferred := ls.takeDeferred()
+	n.ReqMu.Unlock()
+
+	n.sendDeferredResponses(deferred, n.GetLamportClock())
+}
+
+// Handle ignores Deliver messages; Ricart-Agrawala has RPCs of its own.
+func (ra *ricartAgrawala) Handle(msg *pb.AlgorithmMessage) {
+	ra.n.logf("Node %s ignoring %s message %s from %s", ra.n.ID, msg.Algorithm, msg.Kind, msg.NodeId)
+}
+
+func (ra *ricartAgrawala) State(lock string) string {
+	n := ra.n
+	n.ReqMu.Lock()
+	defer n.ReqMu.Unlock()
+
+	ls, ok := n.locks[lock]
+	if !ok {
+		return ""
+	}
+	var state []string
+	if ls.round != nil && !ls.inCS {
+		state = append(state, fmt.Sprintf("waiting for %d of %d replies", max(len(ls.round.pending)-ls.round.slack, 0), len(ls.round.participants)))
+	}
+	if ra.reuse {
+		state = append(state, fmt.Sprintf("holding %d permissions", len(ls.authorized)))
+	}
+	return strings.Join(state, "; ")
+}
+
+// Leave answers every deferred request before the peers stop listening to us.
+func (ra *ricartAgrawala) Leave() {
+	n := ra.n
+	n.ReqMu.Lock()
+	deferred := list.New()
+	for _, ls := range n.locks {
+		deferred.PushBackList(ls.takeDeferred())
+		clear(ls.authorized)
+		n.collectLock(ls)
+	}
+	n.ReqMu.Unlock()
+	n.sendDeferredResponses(deferred, n.GetLamportClock())
+}
+
+// PeerRestarted forgets the requests of peerID's previous run, along with
+// the replies owed to them and any permission of it we kept, and asks the new
+// run again if our request was still waiting for the old one.
+func (ra *ricartAgrawala) PeerRestarted(peerID string) {
+	n := ra.n
+	n.ReqMu.Lock()
+	defer n.ReqMu.Unlock()
+
+	for _, ls := range n.locks {
+		delete(ls.withdrawn, peerID)
+		for _, req := range ls.forgetPeer(peerID) {
+			n.persistLater(walRecord{Op: walAnswer, Lock: req.Lock, Node: req.NodeId, RequestID: req.RequestId})
+		}
+		if ls.round != nil && ls.round.pending[peerID] {
+			n.logf("Node %s asking %s again for lock %s", n.ID, peerID, ls.name)
+			n.PeerMu.RLock()
+			client := n.Peers[peerID]
+			n.PeerMu.RUnlock()
+			if client != nil {
+				ls.round.ask(peerID, client)
+			}
+		}
+		n.collectLock(ls)
+	}
+}
+
+// HandleRequest answers a peer's request: at once, or once we leave the
+// critical section if we are in it or want it with an earlier request. It
+// fails without answering if the answer cannot be written to the write-ahead
+// log, and the peer asks again.
+func (ra *ricartAgrawala) HandleRequest(req *pb.AccessRequest) (*pb.AccessResponse, error) {
+	n := ra.n
+	n.ReqMu.Lock()
+	defer n.ReqMu.Unlock()
+
+	// Update Lamport clock on message receipt
+	timestamp := n.UpdateLamportClock(req.LamportTimestamp)
+	n.mergeVector(req.VectorClock)
+
+	n.logf("Node %s received %s request from %s for lock %s with %s", n.ID, req.Mode, req.NodeId, req.Lock, n.stamp(req.LamportTimestamp))
+
+	// Locks we have never touched need no state: just grant. The same goes for
+	// a request that was withdrawn before it reached us.
+	ls, ok := n.locks[req.Lock]
+	if ok && req.RequestId > ls.withdrawn[req.NodeId] {
+		// A peer we did not ask (it was dead or unknown when we sent our
+		// request) cannot have seen it, so it must wait until we are done
+		// rather than win on priority.
+		kept := ls.authorized[req.NodeId]
+		outsider := ls.round != nil && !ls.round.participants[req.NodeId] && !kept
+		// A peer whose permission we kept was not asked either, but it may
+		// win on priority: it gets the permission back and is asked again.
+		// Once the round has let us in it is too late for that.
+		entering := kept && ls.round != nil && ls.round.finished
+		// Readers never hold each other up; anything involving a writer is
+		// ordered by priority, which keeps writers from starving behind a
+		// stream of later readers.
+		conflict := ls.current != nil && (req.Mode == pb.LockMode_EXCLUSIVE || ls.current.Mode == pb.LockMode_EXCLUSIVE)
+		if ls.current != nil && max(req.Permits, 1) != max(ls.current.Permits, 1) {
+			n.logf("Node %s uses %d permits for lock %s but %s uses %d", n.ID, max(ls.current.Permits, 1), req.Lock, req.NodeId, max(req.Permits, 1))
+		}
+
+		if (ls.inCS && conflict) || (ls.wantCS && !ls.inCS && (outsider || entering || (conflict && n.isHigherPriority(ls.current, req)))) {
+			if err := n.persist(walRecord{
+				Op:          walDefer,
+				Lock:        req.Lock,
+				Node:        req.NodeId,
+				RequestID:   req.RequestId,
+				Timestamp:   req.LamportTimestamp,
+				Mode:        req.Mode.String(),
+				Permits:     req.Permits,
+				Incarnation: req.Incarnation,
+			}, true); err != nil {
+				return nil, err
+			}
+			ls.deferResponse(req)
+			n.logf("Node %s deferring response to %s for lock %s", n.ID, req.NodeId, req.Lock)
+			return &pb.AccessResponse{
+				Granted:          false,
+				LamportTimestamp: timestamp,
+				LeaseRemainingMs: ls.leaseRemainingMs(),
+				VectorClock:      n.tickVector(),
+				Incarnation:      n.Incarnation,
+			}, nil
+		}
+	}
+
+	// Our clock is now past the request's, so once this is on disk no
+	// request of ours can win against it, even after a restart.
+	if err := n.persist(walRecord{Op: walGrant, Lock: req.Lock, Node: req.NodeId, RequestID: req.RequestId}, true); err != nil {
+		return nil, err
+	}
+	if ok && ls.authorized[req.NodeId] {
+		delete(ls.authorized, req.NodeId)
+		if ls.wantCS && ls.round != nil && !ls.round.finished {
+			n.logf("Node %s asking %s again for lock %s", n.ID, req.NodeId, req.Lock)
+			n.PeerMu.RLock()
+			client := n.Peers[req.NodeId]
+			n.PeerMu.RUnlock()
+			if client != nil {
+				ls.round.ask(req.NodeId, client)
+			}
+		}
+		n.collectLock(ls)
+	}
+
+	n.logf("Node %s granting %s access to lock %s", n.ID, req.NodeId, req.Lock)
+	n.countMessages(1, 0)
+	return &pb.AccessResponse{Granted: true, LamportTimestamp: timestamp, VectorClock: n.tickVector(), Incarnation: n.Incarnation}, nil
+}
+
+// HandleRelease credits a peer's reply to our request.
+func (ra *ricartAgrawala) HandleRelease(req *pb.ReleaseRequest) *pb.ReleaseResponse {
+	n := ra.n
+
+	// Update Lamport clock on release message
+	timestamp := n.UpdateLamportClock(req.LamportTimestamp)
+	n.mergeVector(req.VectorClock)
+
+	n.logf("Node %s received release from %s for lock %s with %s", n.ID, req.NodeId, req.Lock, n.stamp(req.LamportTimestamp))
+	if n.fromThisRun(req.RequestIncarnation) {
+		n.ReqMu.Lock()
+		ra.recordReply(n.locks[req.Lock], req.NodeId, req.RequestId)
+		n.ReqMu.Unlock()
+	} else {
+		n.logf("Node %s ignoring reply from %s to request %d of a previous run", n.ID, req.NodeId, req.RequestId)
+	}
+
+	return &pb.ReleaseResponse{Acknowledged: true, LamportTimestamp: timestamp, VectorClock: n.tickVector(), Incarnation: n.Incarnation}
+}
+
+// permissions returns the algorithm of the node if it asks for permission
+// over RequestAccess and ReleaseAccess, whose RPCs are only answered by nodes
+// running such an algorithm.
+func (n *Node) permissions() (PermissionAlgorithm, error) {
+	algo := n.algorithm()
+	if algo == nil {
+		return nil, n.errNotStarted()
+	}
+	pa, ok := algo.(PermissionAlgorithm)
+	if !ok {
+		return nil, fmt.Errorf("node %s runs %s, which does not ask for permissions", n.ID, algo.Name())
+	}
+	return pa, nil
+}
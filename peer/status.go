@@ -0,0 +1,97 @@
+package peer
+
+import (
+	"context"
+	pb "mutex/stc"
+	"sort"
+	"time"
+)
+
+// Status reports the node's request state and how the failure detector sees
+// each peer. It backs the Status RPC and is equally usable in-process.
+func (n *Node) Status(ctx context.Context, req *pb.StatusRequest) (*pb.StatusResponse, error) {
+	n.ReqMu.Lock()
+	state := "RELEASED"
+	locks := make([]*pb.LockStatus, 0, len(n.locks))
+	for name, ls := range n.locks {
+		if name == DefaultLock {
+			state = ls.state()
+		}
+		status := &pb.LockStatus{
+			Name:     name,
+			State:    ls.state(),
+			Deferred: uint32(ls.deferred.Len()),
+		}
+		if ls.inCS {
+			status.FencingToken = ls.token.proto()
+		}
+		if ls.current != nil {
+			status.Mode = ls.current.Mode
+			status.Permits = ls.current.Permits
+		}
+		locks = append(locks, status)
+	}
+	n.ReqMu.Unlock()
+	// Outside ReqMu: an algorithm may take it to answer.
+	var incarnation uint64 // chosen by Start
+	var algorithm string
+	if algo := n.algorithm(); algo != nil {
+		incarnation = n.Incarnation
+		algorithm = algo.Name()
+		for _, status := range locks {
+			status.AlgorithmState = algo.State(status.Name)
+		}
+	}
+	sort.Slice(locks, func(i, j int) bool { return locks[i].Name < locks[j].Name })
+
+	n.LamMu.Lock()
+	clock := n.LamportClock
+	n.LamMu.Unlock()
+
+	n.statsMu.Lock()
+	sent, saved := n.messagesSent, n.messagesSaved
+	n.statsMu.Unlock()
+
+	clockName := n.Config.Clock
+	if clockName == "" {
+		clockName = ClockLamport
+	}
+
+	now := time.Now()
+	n.PeerMu.RLock()
+	peers := make([]*pb.PeerStatus, 0, len(n.peerInfo))
+	for id, info := range n.peerInfo {
+		peers = append(peers, &pb.PeerStatus{
+			NodeId:  id,
+			Address: info.address,
+			State:   info.state.String(),
+			Phi:     info.detector.phi(now),
+
+			Incarnation: info.incarnation,
+		})
+	}
+	n.PeerMu.RUnlock()
+	sort.Slice(peers, func(i, j int) bool { return peers[i].NodeId < peers[j].NodeId })
+
+	return &pb.StatusResponse{
+		NodeId:           n.ID,
+		LamportTimestamp: clock,
+		State:            state,
+		Peers:            peers,
+		Locks:            locks,
+		Algorithm:        algorithm,
+		MessagesSent:     sent,
+		MessagesSaved:    saved,
+		VectorClock:      n.VectorClock(),
+		Clock:            clockName,
+		Incarnation:      incarnation,
+	}, nil
+}
+
+// countMessages adds to the message counters reported by Status.
+func (n *Node) countMessages(sent, saved int) {
+	n.statsMu.Lock()
+	n.messagesSent += uint64(sent)
+	n.messagesSaved += uint64(saved)
+	n.statsMu.Unlock()
+}
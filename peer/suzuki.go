@@ -0,0 +1,240 @@
+package peer
+
+import (
+	"context"
+	"fmt"
+	pb "mutex/stc"
+	"slices"
+	"sync"
+)
+
+// Kinds of Suzuki-Kasami messages.
+const (
+	skRequest = "REQUEST"
+	skToken   = "TOKEN"
+)
+
+// suzukiKasami is the Suzuki-Kasami broadcast token algorithm. Each lock has
+// a single token; whoever holds it may enter. A node without the token
+// broadcasts its next request number, and the holder passes the token on when
+// it is done, so an entry costs N messages, or none while the token stays put.
+// Requires exclusive mode, one permit and no lease.
+type suzukiKasami struct {
+	n     *Node
+	mu    sync.Mutex // guards locks
+	locks map[string]*skLock
+}
+
+// skLock is the Suzuki-Kasami state of one lock. Unlike lockState it is never
+// collected, since the token must not get lost.
+type skLock struct {
+	rn      map[string]uint64 // highest request number seen per node
+	token   *pb.Token         // held token, nil if another node has it
+	hops    uint64            // hop count of the last token this node took or passed on
+	inCS    bool
+	waiting chan struct{} // closed when the token arrives for a local request
+}
+
+func newSuzukiKasami(n *Node) (MutexAlgorithm, error) {
+	return &suzukiKasami{n: n, locks: make(map[string]*skLock)}, nil
+}
+
+func (sk *suzukiKasami) Name() string {
+	return AlgorithmSuzukiKasami
+}
+
+// lock returns the state of name, creating it on first use. The founding
+// member, as decided by Node.Ready, creates the token. Must be called with mu
+// held.
+func (sk *suzukiKasami) lock(name string) *skLock {
+	s, ok := sk.locks[name]
+	if !ok {
+		s = &skLock{rn: make(map[string]uint64)}
+		if sk.n.founder() {
+			sk.n.logf("Node %s creates the token for lock %s", sk.n.ID, name)
+			s.token = &pb.Token{LastGranted: make(map[string]uint64)}
+		}
+		sk.locks[name] = s
+	}
+	return s
+}
+
+func (sk *suzukiKasami) Request(ctx context.Context, req *Request) error {
+	if err := exclusiveOnly(req); err != nil {
+		return err
+	}
+	name := req.Lock
+	n := sk.n
+	sk.mu.Lock()
+	s := sk.lock(name)
+	if s.token != nil {
+		s.inCS = true
+		sk.mu.Unlock()
+		return nil
+	}
+	s.rn[n.ID]++
+	seq := s.rn[n.ID]
+	waiting := make(chan struct{})
+	s.waiting = waiting
+	sk.mu.Unlock()
+
+	n.logf("Node %s broadcasting request %d for the token of lock %s", n.ID, seq, name)
+	n.broadcast(&pb.AlgorithmMessage{Kind: skRequest, Lock: name, Sequence: seq})
+
+	select {
+	case <-waiting:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (sk *suzukiKasami) Release(name string) {
+	sk.mu.Lock()
+	s := sk.lock(name)
+	s.inCS = false
+	s.waiting = nil
+	to, msg := sk.passToken(name, s)
+	sk.mu.Unlock()
+
+	sk.sendToken(to, msg)
+}
+
+func (sk *suzukiKasami) Handle(msg *pb.AlgorithmMessage) {
+	sk.mu.Lock()
+	s := sk.lock(msg.Lock)
+	var to string
+	var out *pb.AlgorithmMessage
+	switch msg.Kind {
+	case skRequest:
+		s.rn[msg.NodeId] = max(s.rn[msg.NodeId], msg.Sequence)
+		if s.token != nil && !s.inCS && s.rn[msg.NodeId] > s.token.LastGranted[msg.NodeId] {
+			to, out = msg.NodeId, sk.giveToken(msg.Lock, s)
+		}
+	case skToken:
+		// Send delivers at least once, so a token can arrive again after it
+		// was taken, or even after it was passed on. Every hop counts up, so
+		// a copy carries a count this node has already seen.
+		if s.token != nil || s.inCS || msg.Sequence <= s.hops {
+			sk.n.logf("Node %s dropping a copy of the token of lock %s from %s (hop %d)", sk.n.ID, msg.Lock, msg.NodeId, msg.Sequence)
+			break
+		}
+		s.token = msg.Token
+		s.hops = msg.Sequence
+		if s.token.LastGranted == nil {
+			s.token.LastGranted = make(map[string]uint64)
+		}
+		if s.waiting != nil {
+			close(s.waiting)
+			s.waiting = nil
+			s.inCS = true
+		} else {
+			// The request was abandoned; serve whoever is next.
+			to, out = sk.passToken(msg.Lock, s)
+		}
+	default:
+		sk.n.logf("Node %s ignoring unknown %s message %s", sk.n.ID, sk.Name(), msg.Kind)
+	}
+	sk.mu.Unlock()
+
+	sk.sendToken(to, out)
+}
+
+func (sk *suzukiKasami) State(name string) string {
+	sk.mu.Lock()
+	defer sk.mu.Unlock()
+
+	s, ok := sk.locks[name]
+	switch {
+	case !ok:
+		return ""
+	case s.token != nil:
+		return fmt.Sprintf("holding the token, %d queued", len(s.token.Queue))
+	case s.waiting != nil:
+		return fmt.Sprintf("waiting for the token (request %d)", s.rn[sk.n.ID])
+	default:
+		return ""
+	}
+}
+
+// passToken records that our request is served, queues every node with an
+// outstanding request and takes the token away from s if someone is waiting.
+// Must be called with mu held.
+func (sk *suzukiKasami) passToken(name string, s *skLock) (string, *pb.AlgorithmMessage) {
+	if s.token == nil {
+		return "", nil
+	}
+	token := s.token
+	token.LastGranted[sk.n.ID] = s.rn[sk.n.ID]
+
+	ids := make([]string, 0, len(s.rn))
+	for id := range s.rn {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	for _, id := range ids {
+		if id != sk.n.ID && s.rn[id] > token.LastGranted[id] && !slices.Contains(token.Queue, id) {
+			token.Queue = append(token.Queue, id)
+		}
+	}
+	if len(token.Queue) == 0 {
+		return "", nil
+	}
+	to := token.Queue[0]
+	token.Queue = token.Queue[1:]
+	return to, sk.giveToken(name, s)
+}
+
+// giveToken takes the token away from s and returns the message that passes
+// it on, numbered with the next hop. Must be called with mu held.
+func (sk *suzukiKasami) giveToken(name string, s *skLock) *pb.AlgorithmMessage {
+	s.hops++
+	msg := &pb.AlgorithmMessage{Kind: skToken, Lock: name, Token: s.token, Sequence: s.hops}
+	s.token = nil
+	return msg
+}
+
+// sendToken posts msg, which passes a token on, to the node to. Posting
+// keeps Handle from waiting on the receiver. Once posted the token is gone
+// from this node: if the receiver cannot be reached it is lost, since
+// taking it back would make a second token should the receiver have got it
+// after all.
+func (sk *suzukiKasami) sendToken(to string, msg *pb.AlgorithmMessage) {
+	if msg == nil {
+		return
+	}
+	sk.n.logf("Node %s passing the token of lock %s to %s", sk.n.ID, msg.Lock, to)
+	sk.n.Post(to, msg)
+}
+
+// Leave hands every token we hold to the next node in line, or to the
+// member with the smallest ID if nobody is waiting.
+func (sk *suzukiKasami) Leave() {
+	type handOff struct {
+		to  string
+		msg *pb.AlgorithmMessage
+	}
+	sk.mu.Lock()
+	var handOffs []handOff
+	for name, s := range sk.locks {
+		to, msg := sk.passToken(name, s)
+		if msg == nil && s.token != nil {
+			if peers := sk.n.memberIDs()[1:]; len(peers) > 0 {
+				to, msg = slices.Min(peers), sk.giveToken(name, s)
+			}
+		}
+		if msg != nil {
+			handOffs = append(handOffs, handOff{to, msg})
+		}
+	}
+	sk.mu.Unlock()
+
+	// Unlike sendToken this waits for the hand-off, which must arrive before
+	// the peers forget this node.
+	for _, h := range handOffs {
+		sk.n.logf("Node %s handing the token of lock %s to %s", sk.n.ID, h.msg.Lock, h.to)
+		if err := sk.n.Send(h.to, h.msg); err != nil {
+			sk.n.logf("Node %s lost the token of lock %s: %v", sk.n.ID, h.msg.Lock, err)
+		}
+	}
+}
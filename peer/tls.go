@@ -0,0 +1,156 @@
+package peer
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	pb "mutex/stc"
+	"os"
+	"slices"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	grpcpeer "google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// With Config.TLS set, nodes talk mutual TLS: every connection presents a
+// certificate signed by the cluster's CA, and the subject common name of a
+// node's certificate is its node ID. A node dialing a peer checks that the
+// certificate it gets names that peer, and a node serving a request checks
+// that the node_id in the message names the caller's certificate, so a
+// member cannot send or answer in the name of another.
+//
+// The CA may also sign certificates for LockService clients, which are not
+// members. Member certificates carry MemberOU, and only they may call
+// MutexService or answer a node's dial.
+
+// MemberOU is the subject organizational unit that marks the certificate of
+// a cluster member.
+const MemberOU = "mutex member"
+
+// LoadTLS builds a Config.TLS from a certificate and key in PEM files and
+// the CA that signs the certificates of every member.
+func LoadTLS(certFile, keyFile, caFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load certificate: %v", err)
+	}
+	caPEM, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificate found in %s", caFile)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS13,
+	}, nil
+}
+
+// TransportCredentials returns the dial option for connecting to the node
+// nodeID: mutual TLS with cfg, accepting only a member certificate that
+// names nodeID, or any member's if nodeID is "". A nil cfg gives plain,
+// unauthenticated connections.
+func TransportCredentials(cfg *tls.Config, nodeID string) grpc.DialOption {
+	if cfg == nil {
+		return grpc.WithTransportCredentials(insecure.NewCredentials())
+	}
+	client := cfg.Clone()
+	// Addresses say nothing about who is listening, so the host name check
+	// is replaced by the node ID check below.
+	client.InsecureSkipVerify = true
+	client.VerifyConnection = func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return errors.New("peer sent no certificate")
+		}
+		intermediates := x509.NewCertPool()
+		for _, cert := range cs.PeerCertificates[1:] {
+			intermediates.AddCert(cert)
+		}
+		leaf := cs.PeerCertificates[0]
+		if _, err := leaf.Verify(x509.VerifyOptions{
+			Roots:         cfg.RootCAs,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}); err != nil {
+			return err
+		}
+		if !isMember(leaf) {
+			return fmt.Errorf("certificate of %q is not a member's", leaf.Subject.CommonName)
+		}
+		if nodeID != "" && leaf.Subject.CommonName != nodeID {
+			return fmt.Errorf("certificate is for %q, not node %q", leaf.Subject.CommonName, nodeID)
+		}
+		return nil
+	}
+	return grpc.WithTransportCredentials(credentials.NewTLS(client))
+}
+
+// ServerOptions returns the options for the gRPC server of the node. With
+// Config.TLS it requires a certificate from the CA of every caller, a member
+// certificate for MutexService, and refuses messages whose node_id is not
+// the caller's.
+func (n *Node) ServerOptions() []grpc.ServerOption {
+	if n.Config.TLS == nil {
+		return nil
+	}
+	return []grpc.ServerOption{
+		grpc.Creds(credentials.NewTLS(n.Config.TLS)),
+		grpc.UnaryInterceptor(checkCaller),
+	}
+}
+
+// dialOption is TransportCredentials for the node's own connections.
+func (n *Node) dialOption(peerID string) grpc.DialOption {
+	return TransportCredentials(n.Config.TLS, peerID)
+}
+
+// checkCaller lets only members call MutexService and refuses a request
+// whose node_id is not the identity of the caller's certificate. LockService
+// takes any certificate of the CA, as its requests carry no node_id.
+func checkCaller(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	if !strings.HasPrefix(info.FullMethod, "/"+pb.MutexService_ServiceDesc.ServiceName+"/") {
+		return handler(ctx, req)
+	}
+	cert, err := callerCert(ctx)
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+	caller := cert.Subject.CommonName
+	if !isMember(cert) {
+		return nil, status.Errorf(codes.PermissionDenied, "%s is not a cluster member and may not call %s", caller, info.FullMethod)
+	}
+	if msg, ok := req.(interface{ GetNodeId() string }); ok && caller != msg.GetNodeId() {
+		return nil, status.Errorf(codes.PermissionDenied, "%s may not send %s as node %q", caller, info.FullMethod, msg.GetNodeId())
+	}
+	return handler(ctx, req)
+}
+
+// callerCert returns the verified certificate of the caller.
+func callerCert(ctx context.Context) (*x509.Certificate, error) {
+	p, ok := grpcpeer.FromContext(ctx)
+	if !ok {
+		return nil, errors.New("no peer information")
+	}
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(tlsInfo.State.VerifiedChains) == 0 {
+		return nil, errors.New("caller has no verified certificate")
+	}
+	return tlsInfo.State.VerifiedChains[0][0], nil
+}
+
+// isMember reports whether cert is marked with MemberOU.
+func isMember(cert *x509.Certificate) bool {
+	return slices.Contains(cert.Subject.OrganizationalUnit, MemberOU)
+}
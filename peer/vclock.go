@@ -0,0 +1,79 @@
+package peer
+
+import (
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// The vector clock is kept next to the Lamport clock when
+// Config.VectorClock is set. The Lamport clock orders every event, but two
+// events are only known to be concurrent when neither vector clock is below
+// the other, which is what reconstructing the happens-before relation across
+// nodes needs. Every message carries the sender's vector clock and every log
+// line of the node ends with its own.
+
+// tickVector counts a local event or a send and returns a copy of the vector
+// clock to attach to the message, or nil without vector clocks.
+func (n *Node) tickVector() map[string]uint64 {
+	if !n.Config.VectorClock {
+		return nil
+	}
+	n.vcMu.Lock()
+	defer n.vcMu.Unlock()
+	if n.vectorClock == nil {
+		n.vectorClock = make(map[string]uint64)
+	}
+	n.vectorClock[n.ID]++
+	return maps.Clone(n.vectorClock)
+}
+
+// mergeVector counts the receipt of a message carrying vc: every entry
+// becomes the maximum of ours and the sender's, then ours is incremented.
+func (n *Node) mergeVector(vc map[string]uint64) {
+	if !n.Config.VectorClock {
+		return
+	}
+	n.vcMu.Lock()
+	defer n.vcMu.Unlock()
+	if n.vectorClock == nil {
+		n.vectorClock = make(map[string]uint64)
+	}
+	for id, t := range vc {
+		n.vectorClock[id] = max(n.vectorClock[id], t)
+	}
+	n.vectorClock[n.ID]++
+}
+
+// VectorClock returns a copy of the node's vector clock, or nil unless
+// Config.VectorClock is set.
+func (n *Node) VectorClock() map[string]uint64 {
+	if !n.Config.VectorClock {
+		return nil
+	}
+	n.vcMu.Lock()
+	defer n.vcMu.Unlock()
+	return maps.Clone(n.vectorClock)
+}
+
+// FormatVectorClock renders vc as "node1:3,node2:5" in node ID order.
+func FormatVectorClock(vc map[string]uint64) string {
+	ids := slices.Sorted(maps.Keys(vc))
+	parts := make([]string, len(ids))
+	for i, id := range ids {
+		parts[i] = fmt.Sprintf("%s:%d", id, vc[id])
+	}
+	return strings.Join(parts, ",")
+}
+
+// logf logs like log.Printf and appends the node's vector clock, if it keeps
+// one.
+func (n *Node) logf(format string, args ...any) {
+	if vc := n.VectorClock(); vc != nil {
+		format += " [vc %s]"
+		args = append(args, FormatVectorClock(vc))
+	}
+	log.Printf(format, args...)
+}
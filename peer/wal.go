@@ -0,0 +1,351 @@
+package peer
+
+import (
+	"bufio"
+	"container/list"
+	"context"
+	"encoding/json"
+	"fmt"
+	pb "mutex/stc"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// A node that restarts with an empty memory can let two nodes into the
+// critical section: a request stamped with a Lamport clock that starts over
+// at 0 wins on priority against a request the old run already granted, and
+// reused request IDs get replies meant for the old run's requests credited to
+// new ones. It also never sends the replies the old run deferred, leaving
+// those peers waiting until the failure detector gives up on it, which a
+// quick restart prevents.
+//
+// With Config.WALDir set, the node therefore appends every transition that
+// makes a promise to a write-ahead log and syncs it to disk before the
+// promise leaves the node: a request before it is sent, an entry before its
+// fencing token is handed out, and a grant or deferral before it is answered.
+// Transitions that only settle a promise, like leaving the critical section
+// or sending a deferred reply, are written without waiting; losing them only
+// means doing the same thing again after a restart. Start replays the log,
+// resuming the clock and request IDs past anything the old run gave out and
+// owing the same replies.
+//
+// Permissions kept under AlgorithmRoucairolCarvalho are not logged: their
+// owners may have reclaimed them while the node was down, so a restarted node
+// asks for them again.
+
+// Operations of walRecord.
+const (
+	walCheckpoint  = "checkpoint"  // Clock, RequestID and Incarnation of a compacted log
+	walRequest     = "request"     // we asked for Lock with RequestID
+	walEnter       = "enter"       // we entered with fencing token Timestamp
+	walLeave       = "leave"       // we released Lock or gave up on it
+	walGrant       = "grant"       // we granted Node's request
+	walDefer       = "defer"       // we owe Node a reply to its request
+	walAnswer      = "answer"      // we no longer owe Node that reply
+	walIncarnation = "incarnation" // this run of the node is Incarnation
+)
+
+// walCompactRecords is how many records the log may grow by before it is
+// rewritten with only what a replay needs.
+const walCompactRecords = 10000
+
+// walRecord is one line of the write-ahead log.
+type walRecord struct {
+	Op        string `json:"op"`
+	Clock     uint64 `json:"clock"`          // Lamport clock when the record was written
+	Lock      string `json:"lock,omitempty"` // empty for a checkpoint
+	Node      string `json:"node,omitempty"` // requester of a granted or deferred request
+	RequestID uint64 `json:"request_id,omitempty"`
+	Timestamp uint64 `json:"timestamp,omitempty"` // of the request, or the fencing token on entry
+	Mode      string `json:"mode,omitempty"`
+	Permits   uint32 `json:"permits,omitempty"`
+
+	Incarnation uint64 `json:"incarnation,omitempty"` // of the requester of a deferred request, or of this node
+}
+
+// accessRequest rebuilds the deferred request rec records.
+func (rec walRecord) accessRequest() *pb.AccessRequest {
+	return &pb.AccessRequest{
+		NodeId:           rec.Node,
+		LamportTimestamp: rec.Timestamp,
+		RequestId:        rec.RequestID,
+		Lock:             rec.Lock,
+		Mode:             pb.LockMode(pb.LockMode_value[rec.Mode]),
+		Permits:          rec.Permits,
+		Incarnation:      rec.Incarnation,
+	}
+}
+
+// walState is what replaying a log gives.
+type walState struct {
+	clock       uint64
+	incarnation uint64                 // of the latest run of the node
+	requestID   uint64                 // highest request ID we issued
+	current     map[string]walRecord   // per lock, our request or entry that has not ended
+	deferred    map[string][]walRecord // per lock, the requests we owe a reply
+}
+
+func (s *walState) apply(rec walRecord) {
+	s.clock = max(s.clock, rec.Clock, rec.Timestamp)
+	switch rec.Op {
+	case walCheckpoint:
+		s.requestID = max(s.requestID, rec.RequestID)
+		s.incarnation = max(s.incarnation, rec.Incarnation)
+	case walIncarnation:
+		s.incarnation = max(s.incarnation, rec.Incarnation)
+	case walRequest:
+		s.requestID = max(s.requestID, rec.RequestID)
+		s.current[rec.Lock] = rec
+	case walEnter:
+		s.current[rec.Lock] = rec
+	case walLeave:
+		delete(s.current, rec.Lock)
+	case walDefer:
+		if !slices.ContainsFunc(s.deferred[rec.Lock], rec.answers) {
+			s.deferred[rec.Lock] = append(s.deferred[rec.Lock], rec)
+		}
+	case walAnswer:
+		s.deferred[rec.Lock] = slices.DeleteFunc(s.deferred[rec.Lock], rec.answers)
+		if len(s.deferred[rec.Lock]) == 0 {
+			delete(s.deferred, rec.Lock)
+		}
+	}
+}
+
+// answers reports whether rec and deferral name the same request.
+func (rec walRecord) answers(deferral walRecord) bool {
+	return rec.Node == deferral.Node && rec.RequestID == deferral.RequestID
+}
+
+// records returns the shortest log that replays to s.
+func (s *walState) records() []walRecord {
+	recs := []walRecord{{Op: walCheckpoint, Clock: s.clock, RequestID: s.requestID, Incarnation: s.incarnation}}
+	for _, rec := range s.current {
+		recs = append(recs, rec)
+	}
+	for _, deferred := range s.deferred {
+		recs = append(recs, deferred...)
+	}
+	return recs
+}
+
+// wal is the write-ahead log of a node.
+type wal struct {
+	mu      sync.Mutex // guards everything below
+	path    string
+	file    *os.File
+	records int      // appended since the last compaction
+	state   walState // what replaying the file gives
+}
+
+// openWAL replays the log at path, creating it if needed, and compacts it.
+// A final record that was only partly written when the node stopped is
+// dropped.
+func openWAL(path string) (*wal, error) {
+	w := &wal{
+		path: path,
+		state: walState{
+			current:  make(map[string]walRecord),
+			deferred: make(map[string][]walRecord),
+		},
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var rec walRecord
+			if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+				break
+			}
+			w.state.apply(rec)
+		}
+		err := scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := w.compact(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// append writes rec and, with sync set, only returns once it is on disk.
+func (w *wal) append(rec walRecord, sync bool) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if _, err := w.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	w.state.apply(rec)
+	w.records++
+	if w.records >= walCompactRecords {
+		return w.compact()
+	}
+	if sync {
+		return w.file.Sync()
+	}
+	return nil
+}
+
+// compact replaces the log with the records of its state. The new log is
+// written next to the old one and renamed over it, so a crash leaves one of
+// the two intact. Must be called with mu held, or before w is shared.
+func (w *wal) compact() error {
+	tmp := w.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	out := bufio.NewWriter(f)
+	enc := json.NewEncoder(out)
+	for _, rec := range w.state.records() {
+		if err := enc.Encode(rec); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := out.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := os.Rename(tmp, w.path); err != nil {
+		f.Close()
+		return err
+	}
+	if dir, err := os.Open(filepath.Dir(w.path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	if w.file != nil {
+		w.file.Close()
+	}
+	// f was opened write-only at offset 0 and has been written to its end.
+	w.file = f
+	w.records = 0
+	return nil
+}
+
+// persist appends rec, stamped with the current clock, to the write-ahead
+// log if the node keeps one. With sync set it only returns once rec is on
+// disk, which must happen before the promise rec records is made.
+func (n *Node) persist(rec walRecord, sync bool) error {
+	if n.wal == nil {
+		return nil
+	}
+	n.LamMu.Lock()
+	rec.Clock = n.LamportClock
+	n.LamMu.Unlock()
+	if err := n.wal.append(rec, sync); err != nil {
+		return fmt.Errorf("failed to write the write-ahead log: %v", err)
+	}
+	return nil
+}
+
+// persistLater is persist for records that only settle a promise, whose loss
+// is harmless, so a failure is just logged.
+func (n *Node) persistLater(rec walRecord) {
+	if err := n.persist(rec, false); err != nil {
+		n.logf("Node %s %v", n.ID, err)
+	}
+}
+
+// recover resumes from the state of the write-ahead log: the clock and
+// request IDs continue past anything the previous run gave out, and the
+// replies it owed are owed again. The local callers of the previous run are
+// gone, so whatever they wanted or held is over; replies peers still send
+// for those requests are ignored as stale.
+func (n *Node) recover() {
+	state := &n.wal.state
+	n.LamMu.Lock()
+	n.LamportClock = max(n.LamportClock, state.clock)
+	n.LamMu.Unlock()
+
+	n.ReqMu.Lock()
+	n.nextRequestID = max(n.nextRequestID, state.requestID)
+	for lock, rec := range state.current {
+		n.logf("Node %s recovered: request %d for lock %s ended with the previous run", n.ID, rec.RequestID, lock)
+	}
+	for lock, deferred := range state.deferred {
+		ls := newLockState(lock)
+		for _, rec := range deferred {
+			ls.deferred.PushBack(rec.accessRequest())
+		}
+		n.locks[lock] = ls
+		n.logf("Node %s recovered: owes %d replies for lock %s", n.ID, len(deferred), lock)
+	}
+	n.ReqMu.Unlock()
+
+	// Ends of holds the previous run did not get to write; replaying them is
+	// harmless.
+	for lock := range state.current {
+		n.persistLater(walRecord{Op: walLeave, Lock: lock})
+	}
+	n.logf("Node %s recovered with %s and request ID %d", n.ID, n.stamp(state.clock), state.requestID)
+}
+
+// answerRecovered sends the replies owed from the previous run on locks no
+// local caller has wanted since; a lock in use answers them on release as
+// usual. Replies to peers that are not members yet wait until they are.
+func (n *Node) answerRecovered(ctx context.Context) {
+	ticker := time.NewTicker(n.Config.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		deferred := list.New()
+		waiting := 0
+		n.ReqMu.Lock()
+		n.PeerMu.RLock()
+		for _, ls := range n.locks {
+			if ls.wantCS || ls.inCS {
+				continue
+			}
+			for e := ls.deferred.Front(); e != nil; {
+				next := e.Next()
+				req := e.Value.(*pb.AccessRequest)
+				if _, ok := n.Peers[req.NodeId]; ok {
+					ls.deferred.Remove(e)
+					delete(ls.authorized, req.NodeId)
+					deferred.PushBack(req)
+				} else {
+					waiting++
+				}
+				e = next
+			}
+			n.collectLock(ls)
+		}
+		n.PeerMu.RUnlock()
+		n.ReqMu.Unlock()
+
+		if deferred.Len() > 0 {
+			n.sendDeferredResponses(deferred, n.GetLamportClock())
+		}
+		if waiting == 0 {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
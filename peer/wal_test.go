@@ -0,0 +1,164 @@
+package peer
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func newWALState() walState {
+	return walState{
+		current:  make(map[string]walRecord),
+		deferred: make(map[string][]walRecord),
+	}
+}
+
+func TestWALReplay(t *testing.T) {
+	tests := []struct {
+		name        string
+		records     []walRecord
+		clock       uint64
+		requestID   uint64
+		incarnation uint64
+		current     []string // locks with a request or entry that has not ended
+		deferred    map[string]int
+	}{
+		{
+			name: "request and entry",
+			records: []walRecord{
+				{Op: walRequest, Clock: 3, Lock: "a", RequestID: 1, Timestamp: 4},
+				{Op: walEnter, Clock: 9, Lock: "a", RequestID: 1, Timestamp: 10},
+			},
+			clock: 10, requestID: 1, current: []string{"a"},
+		},
+		{
+			name: "left",
+			records: []walRecord{
+				{Op: walRequest, Clock: 3, Lock: "a", RequestID: 7, Timestamp: 4},
+				{Op: walLeave, Clock: 12, Lock: "a"},
+			},
+			clock: 12, requestID: 7,
+		},
+		{
+			name: "checkpoint keeps the request ID",
+			records: []walRecord{
+				{Op: walCheckpoint, Clock: 40, RequestID: 12},
+				{Op: walRequest, Clock: 41, Lock: "a", RequestID: 3},
+			},
+			clock: 41, requestID: 12, current: []string{"a"},
+		},
+		{
+			name: "deferral written twice is owed once",
+			records: []walRecord{
+				{Op: walDefer, Clock: 5, Lock: "a", Node: "n2", RequestID: 2, Timestamp: 4},
+				{Op: walDefer, Clock: 6, Lock: "a", Node: "n2", RequestID: 2, Timestamp: 4},
+				{Op: walDefer, Clock: 7, Lock: "b", Node: "n3", RequestID: 1, Timestamp: 6},
+			},
+			clock: 7, deferred: map[string]int{"a": 1, "b": 1},
+		},
+		{
+			name: "answered",
+			records: []walRecord{
+				{Op: walDefer, Clock: 5, Lock: "a", Node: "n2", RequestID: 2, Timestamp: 4},
+				{Op: walDefer, Clock: 6, Lock: "a", Node: "n3", RequestID: 8, Timestamp: 5},
+				{Op: walAnswer, Clock: 9, Lock: "a", Node: "n2", RequestID: 2},
+				{Op: walAnswer, Clock: 9, Lock: "a", Node: "n3", RequestID: 7}, // an older request
+			},
+			clock: 9, deferred: map[string]int{"a": 1},
+		},
+		{
+			name: "incarnation never goes back",
+			records: []walRecord{
+				{Op: walIncarnation, Clock: 1, Incarnation: 500},
+				{Op: walIncarnation, Clock: 2, Incarnation: 300}, // the wall clock stepped back
+			},
+			clock: 2, incarnation: 500,
+		},
+		{
+			name: "grant only moves the clock",
+			records: []walRecord{
+				{Op: walGrant, Clock: 20, Lock: "a", Node: "n2", RequestID: 5},
+			},
+			clock: 20,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newWALState()
+			for _, rec := range tt.records {
+				s.apply(rec)
+			}
+			check := func(s walState) {
+				t.Helper()
+				if s.clock != tt.clock || s.requestID != tt.requestID || s.incarnation != tt.incarnation {
+					t.Errorf("clock %d, request ID %d and incarnation %d, want %d, %d and %d", s.clock, s.requestID, s.incarnation, tt.clock, tt.requestID, tt.incarnation)
+				}
+				if len(s.current) != len(tt.current) {
+					t.Errorf("current %v, want locks %v", s.current, tt.current)
+				}
+				for _, lock := range tt.current {
+					if _, ok := s.current[lock]; !ok {
+						t.Errorf("no current request for lock %s", lock)
+					}
+				}
+				deferred := make(map[string]int)
+				for lock, recs := range s.deferred {
+					deferred[lock] = len(recs)
+				}
+				if len(deferred) == 0 {
+					deferred = nil
+				}
+				if !reflect.DeepEqual(deferred, tt.deferred) {
+					t.Errorf("deferred %v, want %v", deferred, tt.deferred)
+				}
+			}
+			check(s)
+
+			// A compacted log must replay to the same state.
+			compacted := newWALState()
+			for _, rec := range s.records() {
+				compacted.apply(rec)
+			}
+			check(compacted)
+		})
+	}
+}
+
+func TestOpenWALDropsTornRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "node1.wal")
+	log := `{"op":"request","clock":3,"lock":"a","request_id":1,"timestamp":4}
+{"op":"defer","clock":5,"lock":"a","node":"n2","request_id":2,"timestamp":4}
+{"op":"enter","clock":8,"lock":"a","requ`
+	if err := os.WriteFile(path, []byte(log), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	w, err := openWAL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.file.Close()
+
+	if w.state.clock != 5 || w.state.requestID != 1 {
+		t.Errorf("clock %d and request ID %d, want 5 and 1", w.state.clock, w.state.requestID)
+	}
+	if rec := w.state.current["a"]; rec.Op != walRequest {
+		t.Errorf("current record for lock a is %q, want %q", rec.Op, walRequest)
+	}
+	if len(w.state.deferred["a"]) != 1 {
+		t.Errorf("%d replies owed for lock a, want 1", len(w.state.deferred["a"]))
+	}
+
+	// The torn record is gone from the compacted log, which appends cleanly.
+	if err := w.append(walRecord{Op: walLeave, Clock: 9, Lock: "a"}, true); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := openWAL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.file.Close()
+	if len(reopened.state.current) != 0 || reopened.state.clock != 9 {
+		t.Errorf("reopened log has current %v and clock %d, want none and 9", reopened.state.current, reopened.state.clock)
+	}
+}
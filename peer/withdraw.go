@@ -0,0 +1,85 @@
+package peer
+
+import (
+	"context"
+	pb "mutex/stc"
+	"time"
+)
+
+// withdrawTimeout bounds how long an abandoned request keeps trying to tell a
+// peer about it.
+const withdrawTimeout = 5 * time.Second
+
+// --- Server functions ---
+func (n *Node) Withdraw(ctx context.Context, req *pb.WithdrawRequest) (*pb.WithdrawResponse, error) {
+	if _, err := n.permissions(); err != nil {
+		return nil, err
+	}
+	if err := n.checkIncarnation(req.NodeId, req.Incarnation); err != nil {
+		return nil, err
+	}
+	n.UpdateLamportClock(req.LamportTimestamp)
+	n.mergeVector(req.VectorClock)
+
+	n.ReqMu.Lock()
+	defer n.ReqMu.Unlock()
+
+	// A peer has at most one request per lock in flight, so remembering the
+	// highest withdrawn request ID is enough to recognise a withdrawn request
+	// that arrives late. A request for a lock without state here is granted
+	// anyway, so it is kept in the lock's state and forgotten with it.
+	if ls, ok := n.locks[req.Lock]; ok {
+		ls.withdrawn[req.NodeId] = max(ls.withdrawn[req.NodeId], req.RequestId)
+		for e := ls.deferred.Front(); e != nil; e = e.Next() {
+			queued := e.Value.(*pb.AccessRequest)
+			if queued.NodeId == req.NodeId && queued.RequestId == req.RequestId {
+				ls.deferred.Remove(e)
+				n.persistLater(walRecord{Op: walAnswer, Lock: req.Lock, Node: req.NodeId, RequestID: req.RequestId})
+				n.logf("Node %s dropped withdrawn request %d from %s for lock %s", n.ID, req.RequestId, req.NodeId, req.Lock)
+				break
+			}
+		}
+		n.collectLock(ls)
+	}
+	return &pb.WithdrawResponse{}, nil
+}
+
+// --- client functions ---
+
+// withdraw tells every peer round asked to forget request, so no peer keeps
+// a deferred reply for it. Replies we deferred meanwhile are answered by
+// Release as usual.
+func (ra *ricartAgrawala) withdraw(request *pb.AccessRequest, round *replyRound) {
+	n := ra.n
+	withdraw := &pb.WithdrawRequest{
+		NodeId:           n.ID,
+		Lock:             request.Lock,
+		RequestId:        request.RequestId,
+		LamportTimestamp: n.GetLamportClock(),
+		VectorClock:      n.tickVector(),
+		Incarnation:      n.Incarnation,
+	}
+	n.ReqMu.Lock()
+	asked := make([]string, 0, len(round.participants))
+	for id := range round.participants {
+		asked = append(asked, id)
+	}
+	n.ReqMu.Unlock()
+
+	n.PeerMu.RLock()
+	defer n.PeerMu.RUnlock()
+	for _, peerID := range asked {
+		client, ok := n.Peers[peerID]
+		if !ok {
+			continue
+		}
+		n.countMessages(1, 0)
+		go func(id string, c pb.MutexServiceClient) {
+			ctx, cancel := context.WithTimeout(context.Background(), withdrawTimeout)
+			defer cancel()
+			if _, err := c.Withdraw(ctx, withdraw); err != nil {
+				n.logf("Error withdrawing request %d from %s: %v", withdraw.RequestId, id, err)
+			}
+		}(peerID, client)
+	}
+}